@@ -1,48 +1,275 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/Qv2ray/gun/pkg/config"
 	"github.com/Qv2ray/gun/pkg/impl"
+	"github.com/Qv2ray/gun/pkg/metrics"
 )
 
 var (
-	RunMode     = flag.String("mode", "", "run mode. must be client or server")
-	LocalAddr   = flag.String("local", "", "local address to listen")
-	RemoteAddr  = flag.String("remote", "", "remote address to connect")
-	ServiceName = flag.String("name", "GunService", "")
-	CertPath    = flag.String("cert", "", "(server) certificate (*.pem) path")
-	KeyPath     = flag.String("key", "", "(server) certificate key (*.key) path")
-	ServerName  = flag.String("sni", "", "(client) optionally override SNI")
-	Cleartext   = flag.Bool("cleartext", false, "use insecure HTTP/2 cleartext mode")
+	ConfigPath     = flag.String("config", "", "run the tunnels of this JSON or YAML file instead of the one given by flags")
+	RunMode        = flag.String("mode", "", "run mode. must be client or server")
+	LocalAddr      = flag.String("local", "", "local address to listen")
+	RemoteAddr     = flag.String("remote", "", "remote address to connect. clients may give several, comma separated, in order of priority")
+	ServiceName    = flag.String("name", config.DefaultServiceName, "")
+	CertPath       = flag.String("cert", "", "certificate (*.pem) path. optional client certificate for client")
+	KeyPath        = flag.String("key", "", "certificate key (*.key) path. optional client certificate key for client")
+	ClientCA       = flag.String("client-ca", "", "(server) require client certificates signed by this CA bundle")
+	CertReload     = flag.Duration("cert-reload", time.Minute, "(server) how often to check the certificate files for changes")
+	ServerName     = flag.String("sni", "", "(client) optionally override SNI")
+	CAPath         = flag.String("ca", "", "(client) trust this CA bundle besides the system ones")
+	Pins           = flag.String("pin", "", "(client) comma separated base64 SHA-256 hashes of pinned server keys")
+	Insecure       = flag.Bool("insecure", false, "(client) skip verifying the server certificate chain")
+	Cleartext      = flag.Bool("cleartext", false, "use insecure HTTP/2 cleartext mode")
+	Multi          = flag.Bool("multi", false, "(client) coalesce writes with TunMulti streams")
+	Target         = flag.String("target", "", "(client) ask the server to forward to this host:port")
+	Inbound        = flag.String("inbound", "forward", "(client) local protocol. must be forward, socks5 or http")
+	ConnectTimeout = flag.Duration("connect-timeout", 5*time.Second, "(client) timeout of each attempt to connect to the server")
+	Routing        = flag.String("routing", "priority", "(client) how streams pick a remote. must be priority or latency")
+	HealthInterval = flag.Duration("health-interval", 10*time.Second, "how often the client checks several remotes, or the server its upstream")
+	Conns          = flag.Int("conns", 1, "(client) number of connections streams are spread over")
+	Pool           = flag.String("pool", "least-streams", "(client) how streams pick a connection. must be least-streams or round-robin")
+	MaxStreams     = flag.Int("max-streams", 0, "(client) open one more connection when all of them carry this many streams")
+	ReverseTarget  = flag.String("reverse-target", "", "(client) hold a reverse tunnel, forwarding its connections to this address")
+	ReverseListen  = flag.String("reverse-listen", "", "(server) listen on this address for the client holding a reverse tunnel, requires -users or -client-ca")
+	Resume         = flag.Bool("resume", false, "(client) resume TCP streams on a new connection when theirs breaks")
+	ResumeTimeout  = flag.Duration("resume-timeout", 30*time.Second, "how long a broken stream may take to resume before it is closed")
+	Padding        = flag.String("padding", "", "(client) add random padding in this range like 16-255 bytes to every hunk, both ways")
+	ChunkSize      = flag.Int("chunk-size", 0, "(client) split data into hunks padded to this many bytes, both ways")
+	DummyInterval  = flag.Duration("dummy-interval", 0, "(client) send a hunk of padding alone after about this long without data, both ways")
+	FallbackDir    = flag.String("fallback-dir", "", "(server) serve this directory to requests which are not gRPC")
+	FallbackURL    = flag.String("fallback-url", "", "(server) proxy requests which are not gRPC to this web server")
+	AcceptProxy    = flag.Bool("accept-proxy", false, "(server) require a PROXY protocol v1 or v2 header on every connection")
+	SendProxy      = flag.Bool("send-proxy", false, "(server) send a PROXY protocol v2 header with the original client address upstream")
+	Allow          = flag.String("allow", "", "(server) comma separated destinations clients may ask for")
+	User           = flag.String("user", "", "(client) optionally authenticate as user with an HMAC of the token")
+	Token          = flag.String("token", "", "(client) token authenticating streams")
+	Users          = flag.String("users", "", "(server) comma separated user:token pairs allowed to connect")
+	RateLimit      = flag.String("rate-limit", "", "bound the bandwidth of all streams together in bytes per second, like 10M, or 1M:10M for up and down")
+	UserRateLimit  = flag.String("user-rate-limit", "", "(server) bound the bandwidth of the streams of each authenticated user, like -rate-limit")
+	StreamRate     = flag.String("stream-rate-limit", "", "bound the bandwidth of each stream, like -rate-limit")
+	UdpTimeout     = flag.Duration("udp-timeout", 2*time.Minute, "clear UDP sessions idle for this long")
+	MaxUdpSessions = flag.Int("max-udp-sessions", 0, "close the least recently active UDP session to open another beyond this many, unlimited if 0")
+	UdpNat         = flag.String("udp-nat", "port-restricted", "(server) which peers may answer UDP sessions. must be port-restricted, restricted or full-cone")
+	Drain          = flag.Duration("drain", 30*time.Second, "on SIGTERM or SIGINT, how long active streams may finish before they are closed")
+	MetricsAddr    = flag.String("metrics", "", "optionally serve prometheus metrics on this address at /metrics")
 )
 
 func init() {
 	flag.Parse()
 }
 
+// tunnel is a running client or server.
+type tunnel interface {
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+	Done() <-chan struct{}
+}
+
 func main() {
-	switch strings.ToLower(*RunMode) {
-	case "client":
-		impl.GunServiceClientImpl{
-			RemoteAddr:  *RemoteAddr,
-			LocalAddr:   *LocalAddr,
-			ServerName:  *ServerName,
-			Cleartext:   *Cleartext,
-			ServiceName: *ServiceName,
-		}.Run()
-	case "server":
-		impl.GunServiceServerImpl{
-			RemoteAddr:  *RemoteAddr,
-			LocalAddr:   *LocalAddr,
-			CertPath:    *CertPath,
-			KeyPath:     *KeyPath,
-			Cleartext:   *Cleartext,
-			ServiceName: *ServiceName,
-		}.Run()
-	default:
-		log.Fatalf("invalid run mode. must be client or server.")
+	var conf *config.Config
+	if *ConfigPath != "" {
+		var err error
+		conf, err = config.Load(*ConfigPath)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	} else {
+		t := flagTunnel()
+		if err := t.Validate(); err != nil {
+			log.Fatalf("invalid arguments: %v", err)
+		}
+		conf = &config.Config{Tunnels: []config.Tunnel{t}}
+	}
+	if *MetricsAddr != "" {
+		conf.Metrics = *MetricsAddr
+	}
+
+	if conf.Drain == 0 {
+		conf.Drain = *Drain
+	}
+
+	if conf.Metrics != "" {
+		go serveMetrics(conf.Metrics)
+	}
+
+	tunnels := make([]tunnel, len(conf.Tunnels))
+	var servers []*impl.GunServiceServerImpl
+	for i := range conf.Tunnels {
+		switch conf.Tunnels[i].Mode {
+		case config.ModeClient:
+			tunnels[i] = conf.Tunnels[i].Client()
+		case config.ModeServer:
+			server := conf.Tunnels[i].Server()
+			servers = append(servers, server)
+			tunnels[i] = server
+		}
+	}
+
+	// reload certificates on SIGHUP, e.g. after a renewal
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			for _, server := range servers {
+				if err := server.ReloadCertificate(); err != nil {
+					log.Printf("failed to reload certificate of %v: %v", server.LocalAddr, err)
+				}
+			}
+		}
+	}()
+
+	// drain on SIGTERM or SIGINT, a second one exits at once
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+
+	// the process ends with any of its tunnels
+	stopped := make(chan int, len(tunnels))
+	for i, t := range tunnels {
+		if err := t.Start(context.Background()); err != nil {
+			log.Fatalf("%v abort: %v", describe(conf, i), err)
+		}
+		go func(i int, t tunnel) {
+			<-t.Done()
+			stopped <- i
+		}(i, tunnels[i])
+	}
+	var i int
+	select {
+	case i = <-stopped:
+	case sig := <-term:
+		log.Printf("received %v, draining streams for up to %v", sig, conf.Drain)
+		go func() {
+			<-term
+			log.Fatalf("exiting without draining")
+		}()
+		shutdown(conf, tunnels)
+		log.Printf("all tunnels stopped")
+		return
+	}
+	if server, ok := tunnels[i].(*impl.GunServiceServerImpl); ok && server.Err() != nil {
+		log.Fatalf("%v abort: %v", describe(conf, i), server.Err())
+	}
+	log.Printf("%v stopped", describe(conf, i))
+}
+
+// shutdown stops every tunnel, closing streams still active after the drain
+// timeout.
+func shutdown(conf *config.Config, tunnels []tunnel) {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Drain)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, t := range tunnels {
+		wg.Add(1)
+		go func(i int, t tunnel) {
+			defer wg.Done()
+			if err := t.Shutdown(ctx); err != nil {
+				log.Printf("%v closed active streams: %v", describe(conf, i), err)
+			}
+		}(i, t)
+	}
+	wg.Wait()
+}
+
+// describe names a tunnel in logs, by its index when from a config file.
+func describe(conf *config.Config, i int) string {
+	if *ConfigPath == "" {
+		return conf.Tunnels[i].Mode
+	}
+	return fmt.Sprintf("tunnels[%d]", i)
+}
+
+// flagTunnel describes the tunnel given by flags. Flags not applying to the
+// mode are ignored.
+func flagTunnel() config.Tunnel {
+	t := config.Tunnel{
+		Mode:           strings.ToLower(*RunMode),
+		Local:          *LocalAddr,
+		Remote:         *RemoteAddr,
+		Name:           *ServiceName,
+		Cert:           *CertPath,
+		Key:            *KeyPath,
+		Cleartext:      *Cleartext,
+		UdpTimeout:     *UdpTimeout,
+		HealthInterval: *HealthInterval,
+		ResumeTimeout:  *ResumeTimeout,
+	}
+	t.RateLimit = *RateLimit
+	t.StreamRateLimit = *StreamRate
+	t.MaxUdpSessions = *MaxUdpSessions
+	switch t.Mode {
+	case config.ModeClient:
+		t.SNI = *ServerName
+		t.CA = *CAPath
+		t.Insecure = *Insecure
+		t.Multi = *Multi
+		t.Target = *Target
+		t.Inbound = *Inbound
+		t.User = *User
+		t.Token = *Token
+		t.ConnectTimeout = *ConnectTimeout
+		t.Conns = *Conns
+		t.Routing = *Routing
+		if remotes := strings.Split(*RemoteAddr, ","); len(remotes) > 1 {
+			t.Remote = ""
+			for i, addr := range remotes {
+				t.Remotes = append(t.Remotes, config.Remote{Addr: addr, Priority: i})
+			}
+		}
+		t.Pool = *Pool
+		t.ReverseTarget = *ReverseTarget
+		t.Resume = *Resume
+		t.Padding = *Padding
+		t.ChunkSize = *ChunkSize
+		t.DummyInterval = *DummyInterval
+		t.MaxStreams = *MaxStreams
+		if *Pins != "" {
+			t.Pin = strings.Split(*Pins, ",")
+		}
+	case config.ModeServer:
+		t.ClientCA = *ClientCA
+		t.CertReload = *CertReload
+		t.FallbackDir = *FallbackDir
+		t.FallbackURL = *FallbackURL
+		t.AcceptProxy = *AcceptProxy
+		t.SendProxy = *SendProxy
+		t.ReverseListen = *ReverseListen
+		t.UserRateLimit = *UserRateLimit
+		t.UdpNat = *UdpNat
+		if *Allow != "" {
+			t.Allow = strings.Split(*Allow, ",")
+		}
+		if *Users != "" {
+			t.Users = make(map[string]string)
+			for _, pair := range strings.Split(*Users, ",") {
+				parts := strings.SplitN(pair, ":", 2)
+				if len(parts) != 2 {
+					log.Fatalf("invalid user %q, expect user:token", pair)
+				}
+				t.Users[parts[0]] = parts[1]
+			}
+		}
+	}
+	return t
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Printf("serving metrics on: %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("failed to serve metrics: %v", err)
 	}
 }
@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Qv2ray/gun/pkg/impl"
 )
 
+// defaultDrainTimeout is how long active streams may finish on SIGTERM,
+// unless the drain option says otherwise.
+const defaultDrainTimeout = 10 * time.Second
+
+// tunnel is a running client or server.
+type tunnel interface {
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+	Done() <-chan struct{}
+}
+
 func main() {
 	log.Println("gun is running in SIP003 mode.")
 	arguments, err := GetSIP003Arguments()
@@ -17,24 +33,56 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to parse plugin options: %v", err)
 	}
+	drainTimeout := defaultDrainTimeout
+	if v, ok := options["drain"]; ok {
+		if drainTimeout, err = time.ParseDuration(v); err != nil || drainTimeout <= 0 {
+			log.Fatalf("invalid drain timeout %q", v)
+		}
+	}
 
+	var t tunnel
 	switch options["mode"] {
 	case "client":
-		impl.GunServiceClientImpl{
+		t = &impl.GunServiceClientImpl{
 			RemoteAddr: arguments.RemoteAddr,
 			LocalAddr:  arguments.LocalAddr,
 			ServerName: options["sni"],
 			Cleartext:  options["cleartext"] == "cleartext",
-		}.Run()
+		}
 	case "server":
-		impl.GunServiceServerImpl{
+		t = &impl.GunServiceServerImpl{
 			RemoteAddr: arguments.LocalAddr,
 			LocalAddr:  arguments.RemoteAddr,
 			CertPath:   options["cert"],
 			KeyPath:    options["key"],
 			Cleartext:  options["cleartext"] == "cleartext",
-		}.Run()
+		}
 	default:
 		log.Fatalf("unknown run mode")
 	}
+
+	if err := t.Start(context.Background()); err != nil {
+		log.Fatalf("%v abort: %v", options["mode"], err)
+	}
+
+	// shadowsocks stops its plugin with SIGTERM
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	select {
+	case <-t.Done():
+		if server, ok := t.(*impl.GunServiceServerImpl); ok && server.Err() != nil {
+			log.Fatalf("server abort: %v", server.Err())
+		}
+	case sig := <-term:
+		log.Printf("received %v, draining streams for up to %v", sig, drainTimeout)
+		go func() {
+			<-term
+			log.Fatalf("exiting without draining")
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := t.Shutdown(ctx); err != nil {
+			log.Printf("closed active streams: %v", err)
+		}
+	}
 }
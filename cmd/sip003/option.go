@@ -12,8 +12,23 @@ type PluginOptions map[string]string
 // client
 // client:new-server-name.example.com
 // client:cleartext
+//
+// drain=<duration> may follow either mode, e.g. server:cleartext:drain=30s.
 func ParsePluginOptions(options string) (parsedOptions PluginOptions, err error) {
 	parts := strings.Split(options, ":")
+	last := parts[len(parts)-1]
+	hasDrain := len(parts) > 1 && strings.HasPrefix(last, "drain=")
+	if hasDrain {
+		parts = parts[:len(parts)-1]
+	}
+	parsedOptions, err = parseModeOptions(parts)
+	if err == nil && hasDrain {
+		parsedOptions["drain"] = strings.TrimPrefix(last, "drain=")
+	}
+	return parsedOptions, err
+}
+
+func parseModeOptions(parts []string) (PluginOptions, error) {
 	switch parts[0] {
 	case "client":
 		switch len(parts) {
@@ -0,0 +1,100 @@
+package cert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPairReloader serves a certificate pair read from files, and reloads it
+// when they change. A new pair replaces the current one only once it is
+// validated, so a half written renewal never interrupts service.
+type KeyPairReloader struct {
+	certPath string
+	keyPath  string
+
+	mu   sync.RWMutex
+	pair *tls.Certificate
+	// modification times of the last load attempt
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// NewKeyPairReloader loads the pair for the first time.
+func NewKeyPairReloader(certPath, keyPath string) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads and validates the pair, then swaps it in.
+func (r *KeyPairReloader) Reload() error {
+	certModTime, keyModTime := modTime(r.certPath), modTime(r.keyPath)
+	r.mu.Lock()
+	r.certModTime, r.keyModTime = certModTime, keyModTime
+	r.mu.Unlock()
+
+	pair, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to build certificate pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %v", leaf.NotAfter)
+	}
+	pair.Leaf = leaf
+
+	r.mu.Lock()
+	r.pair = &pair
+	r.mu.Unlock()
+	log.Printf("certificate pair loaded, valid until %v", leaf.NotAfter)
+	return nil
+}
+
+// GetCertificate is suitable for tls.Config.GetCertificate.
+func (r *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pair, nil
+}
+
+// Watch reloads the pair whenever the modification time of either file
+// changes, checking every interval until ctx is done.
+func (r *KeyPairReloader) Watch(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		r.mu.RLock()
+		changed := !modTime(r.certPath).Equal(r.certModTime) || !modTime(r.keyPath).Equal(r.keyModTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			log.Printf("keeping current certificate pair: %v", err)
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
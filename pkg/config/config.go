@@ -0,0 +1,396 @@
+// Package config describes tunnels to run in one process, read from a JSON
+// or YAML file.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/impl"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	ModeClient = "client"
+	ModeServer = "server"
+
+	DefaultServiceName = "GunService"
+)
+
+// Config is the root of a configuration file. Keys are named after the
+// command line flags.
+type Config struct {
+	// Metrics optionally serves prometheus metrics on this address
+	Metrics string `yaml:"metrics"`
+	// Drain is how long active streams may finish on SIGTERM or SIGINT
+	Drain   time.Duration `yaml:"drain"`
+	Tunnels []Tunnel      `yaml:"tunnels"`
+}
+
+// Tunnel is either a client or a server. Fields not applying to its mode
+// must be left empty.
+type Tunnel struct {
+	Mode      string `yaml:"mode"`
+	Local     string `yaml:"local"`
+	Remote    string `yaml:"remote"`
+	Name      string `yaml:"name"`
+	Cert      string `yaml:"cert"`
+	Key       string `yaml:"key"`
+	Cleartext bool   `yaml:"cleartext"`
+
+	// client
+	SNI            string        `yaml:"sni"`
+	CA             string        `yaml:"ca"`
+	Pin            []string      `yaml:"pin"`
+	Insecure       bool          `yaml:"insecure"`
+	Multi          bool          `yaml:"multi"`
+	Target         string        `yaml:"target"`
+	Inbound        string        `yaml:"inbound"`
+	User           string        `yaml:"user"`
+	Token          string        `yaml:"token"`
+	ConnectTimeout time.Duration `yaml:"connect-timeout"`
+	Remotes        []Remote      `yaml:"remotes"`
+	Routing        string        `yaml:"routing"`
+	Conns          int           `yaml:"conns"`
+	Pool           string        `yaml:"pool"`
+	MaxStreams     int           `yaml:"max-streams"`
+	ReverseTarget  string        `yaml:"reverse-target"`
+	Resume         bool          `yaml:"resume"`
+	Padding        string        `yaml:"padding"`
+	ChunkSize      int           `yaml:"chunk-size"`
+	DummyInterval  time.Duration `yaml:"dummy-interval"`
+
+	// server
+	ClientCA      string            `yaml:"client-ca"`
+	Allow         []string          `yaml:"allow"`
+	Users         map[string]string `yaml:"users"`
+	CertReload    time.Duration     `yaml:"cert-reload"`
+	FallbackDir   string            `yaml:"fallback-dir"`
+	FallbackURL   string            `yaml:"fallback-url"`
+	AcceptProxy   bool              `yaml:"accept-proxy"`
+	SendProxy     bool              `yaml:"send-proxy"`
+	ReverseListen string            `yaml:"reverse-listen"`
+	UserRateLimit string            `yaml:"user-rate-limit"`
+	UdpNat        string            `yaml:"udp-nat"`
+
+	UdpTimeout      time.Duration `yaml:"udp-timeout"`
+	MaxUdpSessions  int           `yaml:"max-udp-sessions"`
+	HealthInterval  time.Duration `yaml:"health-interval"`
+	ResumeTimeout   time.Duration `yaml:"resume-timeout"`
+	RateLimit       string        `yaml:"rate-limit"`
+	StreamRateLimit string        `yaml:"stream-rate-limit"`
+}
+
+// Remote is one of several servers of a client. sni and name default to
+// those of the tunnel.
+type Remote struct {
+	Addr     string `yaml:"addr"`
+	SNI      string `yaml:"sni"`
+	Name     string `yaml:"name"`
+	Priority int    `yaml:"priority"`
+}
+
+// Load reads and validates a configuration file. JSON is read as YAML, of
+// which it is a subset.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	c := new(Config)
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("failed to parse config %v: %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %w", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks every tunnel, the error names the first invalid one.
+func (c *Config) Validate() error {
+	if len(c.Tunnels) == 0 {
+		return errors.New("no tunnels")
+	}
+	if c.Drain < 0 {
+		return errors.New("drain must not be negative")
+	}
+	for i := range c.Tunnels {
+		if err := c.Tunnels[i].Validate(); err != nil {
+			return fmt.Errorf("tunnels[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks a tunnel on its own.
+func (t *Tunnel) Validate() error {
+	if t.Mode != ModeClient && t.Mode != ModeServer {
+		return fmt.Errorf("unknown mode %q, must be client or server", t.Mode)
+	}
+	if t.Local == "" && t.ReverseTarget == "" {
+		return errors.New("local is required")
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("cert and key must be given together")
+	}
+	if t.UdpTimeout < 0 || t.HealthInterval < 0 {
+		return errors.New("udp-timeout and health-interval must not be negative")
+	}
+	if t.ResumeTimeout < 0 {
+		return errors.New("resume-timeout must not be negative")
+	}
+	if t.MaxUdpSessions < 0 {
+		return errors.New("max-udp-sessions must not be negative")
+	}
+	for _, l := range []struct{ key, value string }{
+		{"rate-limit", t.RateLimit},
+		{"user-rate-limit", t.UserRateLimit},
+		{"stream-rate-limit", t.StreamRateLimit},
+	} {
+		if _, err := parseRateLimit(l.value); err != nil {
+			return fmt.Errorf("%v: %w", l.key, err)
+		}
+	}
+
+	switch t.Mode {
+	case ModeClient:
+		if t.Remote == "" && len(t.Remotes) == 0 {
+			return errors.New("remote or remotes is required")
+		}
+		if t.Remote != "" && len(t.Remotes) > 0 {
+			return errors.New("remote and remotes are exclusive")
+		}
+		for i, r := range t.Remotes {
+			if r.Addr == "" {
+				return fmt.Errorf("remotes[%d]: addr is required", i)
+			}
+		}
+		switch t.Routing {
+		case "", impl.RoutePriority, impl.RouteLatency:
+		default:
+			return fmt.Errorf("unknown routing %q, must be priority or latency", t.Routing)
+		}
+		switch t.Inbound {
+		case "", impl.InboundForward, impl.InboundSocks5, impl.InboundHttp:
+		default:
+			return fmt.Errorf("unknown inbound %q, must be forward, socks5 or http", t.Inbound)
+		}
+		if t.User != "" && t.Token == "" {
+			return errors.New("user requires a token")
+		}
+		if t.ConnectTimeout < 0 {
+			return errors.New("connect-timeout must not be negative")
+		}
+		switch t.Pool {
+		case "", impl.PoolLeastStreams, impl.PoolRoundRobin:
+		default:
+			return fmt.Errorf("unknown pool %q, must be least-streams or round-robin", t.Pool)
+		}
+		if t.Conns < 0 || t.MaxStreams < 0 {
+			return errors.New("conns and max-streams must not be negative")
+		}
+		if t.Resume && t.Multi {
+			return errors.New("resume and multi are exclusive")
+		}
+		shaping, err := t.shaping()
+		if err != nil {
+			return err
+		}
+		if err := shaping.Validate(); err != nil {
+			return err
+		}
+		if t.Multi && (t.Padding != "" || t.ChunkSize != 0 || t.DummyInterval != 0) {
+			return errors.New("padding, chunk-size and dummy-interval do not apply to multi")
+		}
+		return rejectSet(ModeClient, map[string]bool{
+			"client-ca":       t.ClientCA != "",
+			"allow":           len(t.Allow) > 0,
+			"users":           len(t.Users) > 0,
+			"cert-reload":     t.CertReload != 0,
+			"fallback-dir":    t.FallbackDir != "",
+			"fallback-url":    t.FallbackURL != "",
+			"accept-proxy":    t.AcceptProxy,
+			"send-proxy":      t.SendProxy,
+			"reverse-listen":  t.ReverseListen != "",
+			"user-rate-limit": t.UserRateLimit != "",
+			"udp-nat":         t.UdpNat != "",
+		})
+	case ModeServer:
+		if t.Remote == "" && len(t.Allow) == 0 && t.ReverseListen == "" {
+			return errors.New("remote, allow or reverse-listen is required")
+		}
+		if t.Cleartext {
+			if t.ClientCA != "" {
+				return errors.New("client-ca requires TLS")
+			}
+		} else if t.Cert == "" {
+			return errors.New("cert and key are required unless cleartext")
+		}
+		for user, token := range t.Users {
+			if token == "" {
+				return fmt.Errorf("empty token for user %v", user)
+			}
+		}
+		if t.ReverseListen != "" && len(t.Users) == 0 && t.ClientCA == "" {
+			return errors.New("reverse-listen requires users or client-ca, anyone could take it over otherwise")
+		}
+		if t.FallbackDir != "" && t.FallbackURL != "" {
+			return errors.New("fallback-dir and fallback-url are exclusive")
+		}
+		if t.CertReload < 0 {
+			return errors.New("cert-reload must not be negative")
+		}
+		switch t.UdpNat {
+		case "", impl.NatPortRestricted, impl.NatRestricted, impl.NatFullCone:
+		default:
+			return fmt.Errorf("unknown udp-nat %q, must be port-restricted, restricted or full-cone", t.UdpNat)
+		}
+		return rejectSet(ModeServer, map[string]bool{
+			"sni":             t.SNI != "",
+			"ca":              t.CA != "",
+			"pin":             len(t.Pin) > 0,
+			"insecure":        t.Insecure,
+			"multi":           t.Multi,
+			"target":          t.Target != "",
+			"inbound":         t.Inbound != "",
+			"user":            t.User != "",
+			"token":           t.Token != "",
+			"connect-timeout": t.ConnectTimeout != 0,
+			"remotes":         len(t.Remotes) > 0,
+			"routing":         t.Routing != "",
+			"conns":           t.Conns != 0,
+			"pool":            t.Pool != "",
+			"max-streams":     t.MaxStreams != 0,
+			"reverse-target":  t.ReverseTarget != "",
+			"resume":          t.Resume,
+			"padding":         t.Padding != "",
+			"chunk-size":      t.ChunkSize != 0,
+			"dummy-interval":  t.DummyInterval != 0,
+		})
+	}
+	return nil
+}
+
+// rejectSet fails if any of the keys of another mode is set.
+func rejectSet(mode string, set map[string]bool) error {
+	var keys []string
+	for key, ok := range set {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("%v does not apply to %v mode", strings.Join(keys, ", "), mode)
+}
+
+// serviceName returns the service name, GunService when not set.
+func (t *Tunnel) serviceName() string {
+	if t.Name == "" {
+		return DefaultServiceName
+	}
+	return t.Name
+}
+
+// shaping returns the traffic shaping of a client.
+func (t *Tunnel) shaping() (impl.Shaping, error) {
+	s := impl.Shaping{ChunkSize: t.ChunkSize, DummyInterval: t.DummyInterval}
+	if t.Padding != "" {
+		var err error
+		if s.PaddingMin, s.PaddingMax, err = impl.ParsePadding(t.Padding); err != nil {
+			return impl.Shaping{}, err
+		}
+	}
+	return s, nil
+}
+
+// parseRateLimit parses a rate limit, unlimited if empty.
+func parseRateLimit(v string) (impl.RateLimit, error) {
+	if v == "" {
+		return impl.RateLimit{}, nil
+	}
+	return impl.ParseRateLimit(v)
+}
+
+// Client builds the client of a tunnel in client mode.
+func (t *Tunnel) Client() *impl.GunServiceClientImpl {
+	client := &impl.GunServiceClientImpl{
+		RemoteAddr:          t.Remote,
+		LocalAddr:           t.Local,
+		ServerName:          t.SNI,
+		Cleartext:           t.Cleartext,
+		CertPath:            t.Cert,
+		KeyPath:             t.Key,
+		CAPath:              t.CA,
+		PinnedKeys:          t.Pin,
+		Insecure:            t.Insecure,
+		ServiceName:         t.serviceName(),
+		Multi:               t.Multi,
+		Target:              t.Target,
+		Inbound:             t.Inbound,
+		User:                t.User,
+		Token:               t.Token,
+		ConnectTimeout:      t.ConnectTimeout,
+		UdpTimeout:          t.UdpTimeout,
+		MaxUdpSessions:      t.MaxUdpSessions,
+		Connections:         t.Conns,
+		PoolPolicy:          t.Pool,
+		MaxStreamsPerConn:   t.MaxStreams,
+		Routing:             t.Routing,
+		HealthCheckInterval: t.HealthInterval,
+		ReverseTarget:       t.ReverseTarget,
+		Resume:              t.Resume,
+		ResumeTimeout:       t.ResumeTimeout,
+	}
+	// checked by Validate
+	client.Shaping, _ = t.shaping()
+	client.RateLimit, _ = parseRateLimit(t.RateLimit)
+	client.StreamRateLimit, _ = parseRateLimit(t.StreamRateLimit)
+	for _, r := range t.Remotes {
+		client.Remotes = append(client.Remotes, impl.Remote{
+			Addr:        r.Addr,
+			ServerName:  r.SNI,
+			ServiceName: r.Name,
+			Priority:    r.Priority,
+		})
+	}
+	return client
+}
+
+// Server builds the server of a tunnel in server mode.
+func (t *Tunnel) Server() *impl.GunServiceServerImpl {
+	server := &impl.GunServiceServerImpl{
+		RemoteAddr:          t.Remote,
+		LocalAddr:           t.Local,
+		CertPath:            t.Cert,
+		KeyPath:             t.Key,
+		Cleartext:           t.Cleartext,
+		ServiceName:         t.serviceName(),
+		AllowedTargets:      t.Allow,
+		Users:               t.Users,
+		ClientCAPath:        t.ClientCA,
+		CertReloadInterval:  t.CertReload,
+		UdpTimeout:          t.UdpTimeout,
+		MaxUdpSessions:      t.MaxUdpSessions,
+		HealthCheckInterval: t.HealthInterval,
+		FallbackDir:         t.FallbackDir,
+		FallbackURL:         t.FallbackURL,
+		AcceptProxyProtocol: t.AcceptProxy,
+		SendProxyProtocol:   t.SendProxy,
+		ReverseAddr:         t.ReverseListen,
+		ResumeTimeout:       t.ResumeTimeout,
+		UdpNat:              t.UdpNat,
+	}
+	// checked by Validate
+	server.RateLimit, _ = parseRateLimit(t.RateLimit)
+	server.UserRateLimit, _ = parseRateLimit(t.UserRateLimit)
+	server.StreamRateLimit, _ = parseRateLimit(t.StreamRateLimit)
+	return server
+}
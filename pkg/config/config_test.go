@@ -0,0 +1,260 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/impl"
+)
+
+func clientTunnel() Tunnel {
+	return Tunnel{Mode: ModeClient, Local: "127.0.0.1:1080", Remote: "grpc.example.com:443"}
+}
+
+func serverTunnel() Tunnel {
+	return Tunnel{Mode: ModeServer, Local: ":443", Remote: "127.0.0.1:8899", Cleartext: true}
+}
+
+func TestTunnelValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		tunnel func() Tunnel
+		// err is a part of the error, empty if the tunnel is valid
+		err string
+	}{
+		{"client", clientTunnel, ""},
+		{"server", serverTunnel, ""},
+		{"unknown mode", func() Tunnel { t := clientTunnel(); t.Mode = "relay"; return t }, "unknown mode"},
+		{"no local", func() Tunnel { t := clientTunnel(); t.Local = ""; return t }, "local is required"},
+		{"cert without key", func() Tunnel { t := serverTunnel(); t.Cert = "cert.pem"; return t }, "cert and key"},
+		{"bad rate limit", func() Tunnel { t := clientTunnel(); t.RateLimit = "fast"; return t }, "rate-limit"},
+
+		{"client without remote", func() Tunnel { t := clientTunnel(); t.Remote = ""; return t }, "remote or remotes is required"},
+		{"client with remote and remotes", func() Tunnel {
+			t := clientTunnel()
+			t.Remotes = []Remote{{Addr: "a.example.com:443"}}
+			return t
+		}, "exclusive"},
+		{"client remote without addr", func() Tunnel {
+			t := clientTunnel()
+			t.Remote, t.Remotes = "", []Remote{{SNI: "a.example.com"}}
+			return t
+		}, "remotes[0]: addr is required"},
+		{"reverse client without local", func() Tunnel {
+			t := clientTunnel()
+			t.Local, t.ReverseTarget = "", "127.0.0.1:22"
+			return t
+		}, ""},
+		{"user without token", func() Tunnel { t := clientTunnel(); t.User = "alice"; return t }, "user requires a token"},
+		{"resume with multi", func() Tunnel { t := clientTunnel(); t.Resume, t.Multi = true, true; return t }, "resume and multi"},
+		{"padding with multi", func() Tunnel { t := clientTunnel(); t.Multi, t.Padding = true, "16-255"; return t }, "do not apply to multi"},
+		{"client with server keys", func() Tunnel {
+			t := clientTunnel()
+			t.Allow, t.UdpNat, t.SendProxy = []string{":443"}, impl.NatFullCone, true
+			return t
+		}, "allow, send-proxy, udp-nat does not apply to client mode"},
+		{"client with user rate limit", func() Tunnel { t := clientTunnel(); t.UserRateLimit = "1M"; return t }, "user-rate-limit does not apply to client mode"},
+
+		{"server without destination", func() Tunnel { t := serverTunnel(); t.Remote = ""; return t }, "remote, allow or reverse-listen is required"},
+		{"server without cert", func() Tunnel { t := serverTunnel(); t.Cleartext = false; return t }, "cert and key are required"},
+		{"cleartext server with client ca", func() Tunnel { t := serverTunnel(); t.ClientCA = "ca.pem"; return t }, "client-ca requires TLS"},
+		{"reverse listen without auth", func() Tunnel { t := serverTunnel(); t.ReverseListen = ":2222"; return t }, "reverse-listen requires users or client-ca"},
+		{"reverse listen with users", func() Tunnel {
+			t := serverTunnel()
+			t.ReverseListen, t.Users = ":2222", map[string]string{"alice": "token1"}
+			return t
+		}, ""},
+		{"both fallbacks", func() Tunnel {
+			t := serverTunnel()
+			t.FallbackDir, t.FallbackURL = "/var/www", "http://127.0.0.1:8080"
+			return t
+		}, "fallback-dir and fallback-url are exclusive"},
+		{"server with client keys", func() Tunnel {
+			t := serverTunnel()
+			t.Token, t.Resume, t.Pin = "token1", true, []string{"sha256/x"}
+			return t
+		}, "pin, resume, token does not apply to server mode"},
+		{"server with padding", func() Tunnel { t := serverTunnel(); t.Padding = "16-255"; return t }, "padding does not apply to server mode"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := tt.tunnel()
+			err := tunnel.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("valid tunnel rejected: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTunnelClient(t *testing.T) {
+	tunnel := Tunnel{
+		Mode:            ModeClient,
+		Local:           "127.0.0.1:1080",
+		Cert:            "client.pem",
+		Key:             "client.key",
+		SNI:             "grpc.example.com",
+		CA:              "ca.pem",
+		Pin:             []string{"sha256/x"},
+		Insecure:        true,
+		Target:          "ssh.internal:22",
+		Inbound:         impl.InboundSocks5,
+		User:            "alice",
+		Token:           "token1",
+		ConnectTimeout:  10 * time.Second,
+		Remotes:         []Remote{{Addr: "hk.example.com:443"}, {Addr: "jp.example.com:443", SNI: "jp.example.com", Name: "Jp", Priority: 1}},
+		Routing:         impl.RouteLatency,
+		Conns:           4,
+		Pool:            impl.PoolRoundRobin,
+		MaxStreams:      100,
+		Resume:          true,
+		Padding:         "16-255",
+		ChunkSize:       1024,
+		DummyInterval:   10 * time.Second,
+		UdpTimeout:      time.Minute,
+		MaxUdpSessions:  1000,
+		HealthInterval:  20 * time.Second,
+		ResumeTimeout:   time.Minute,
+		RateLimit:       "1M:10M",
+		StreamRateLimit: "512K",
+	}
+	if err := tunnel.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := &impl.GunServiceClientImpl{
+		LocalAddr:           "127.0.0.1:1080",
+		ServerName:          "grpc.example.com",
+		CertPath:            "client.pem",
+		KeyPath:             "client.key",
+		CAPath:              "ca.pem",
+		PinnedKeys:          []string{"sha256/x"},
+		Insecure:            true,
+		ServiceName:         DefaultServiceName,
+		Target:              "ssh.internal:22",
+		Inbound:             impl.InboundSocks5,
+		User:                "alice",
+		Token:               "token1",
+		ConnectTimeout:      10 * time.Second,
+		UdpTimeout:          time.Minute,
+		MaxUdpSessions:      1000,
+		Connections:         4,
+		PoolPolicy:          impl.PoolRoundRobin,
+		MaxStreamsPerConn:   100,
+		Routing:             impl.RouteLatency,
+		HealthCheckInterval: 20 * time.Second,
+		Resume:              true,
+		ResumeTimeout:       time.Minute,
+		Shaping:             impl.Shaping{PaddingMin: 16, PaddingMax: 255, ChunkSize: 1024, DummyInterval: 10 * time.Second},
+		RateLimit:           impl.RateLimit{Up: 1 << 20, Down: 10 << 20},
+		StreamRateLimit:     impl.RateLimit{Up: 512 << 10, Down: 512 << 10},
+		Remotes: []impl.Remote{
+			{Addr: "hk.example.com:443"},
+			{Addr: "jp.example.com:443", ServerName: "jp.example.com", ServiceName: "Jp", Priority: 1},
+		},
+	}
+	if got := tunnel.Client(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("client\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestTunnelServer(t *testing.T) {
+	tunnel := Tunnel{
+		Mode:            ModeServer,
+		Local:           ":443",
+		Remote:          "127.0.0.1:8899",
+		Name:            "Custom",
+		Cert:            "cert.pem",
+		Key:             "cert.key",
+		ClientCA:        "ca.pem",
+		Allow:           []string{"10.0.0.0/8:22"},
+		Users:           map[string]string{"alice": "token1"},
+		CertReload:      time.Hour,
+		FallbackDir:     "/var/www",
+		AcceptProxy:     true,
+		SendProxy:       true,
+		ReverseListen:   ":2222",
+		UserRateLimit:   "1M",
+		UdpNat:          impl.NatRestricted,
+		UdpTimeout:      time.Minute,
+		MaxUdpSessions:  1000,
+		HealthInterval:  20 * time.Second,
+		ResumeTimeout:   time.Minute,
+		RateLimit:       "50M",
+		StreamRateLimit: "1M:2M",
+	}
+	if err := tunnel.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	want := &impl.GunServiceServerImpl{
+		RemoteAddr:          "127.0.0.1:8899",
+		LocalAddr:           ":443",
+		CertPath:            "cert.pem",
+		KeyPath:             "cert.key",
+		ServiceName:         "Custom",
+		AllowedTargets:      []string{"10.0.0.0/8:22"},
+		Users:               map[string]string{"alice": "token1"},
+		ClientCAPath:        "ca.pem",
+		CertReloadInterval:  time.Hour,
+		UdpTimeout:          time.Minute,
+		MaxUdpSessions:      1000,
+		HealthCheckInterval: 20 * time.Second,
+		FallbackDir:         "/var/www",
+		AcceptProxyProtocol: true,
+		SendProxyProtocol:   true,
+		ReverseAddr:         ":2222",
+		ResumeTimeout:       time.Minute,
+		UdpNat:              impl.NatRestricted,
+		RateLimit:           impl.RateLimit{Up: 50 << 20, Down: 50 << 20},
+		UserRateLimit:       impl.RateLimit{Up: 1 << 20, Down: 1 << 20},
+		StreamRateLimit:     impl.RateLimit{Up: 1 << 20, Down: 2 << 20},
+	}
+	if got := tunnel.Server(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("server\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		err  string
+	}{
+		{"yaml", "tunnels:\n  - {mode: client, local: 127.0.0.1:1080, remote: a.example.com:443, connect-timeout: 10s}\n", ""},
+		{"json", `{"drain": "5s", "tunnels": [{"mode": "server", "local": ":443", "remote": "127.0.0.1:8899", "cleartext": true}]}`, ""},
+		{"unknown key", "tunnels:\n  - {mode: client, local: '127.0.0.1:1080', remote: a:443, colour: red}\n", "field colour not found"},
+		{"no tunnels", "metrics: 127.0.0.1:9100\n", "no tunnels"},
+		{"invalid tunnel", "tunnels:\n  - {mode: client, local: '127.0.0.1:1080'}\n  - {mode: server, local: ':443', token: x}\n", "tunnels[0]: remote or remotes is required"},
+		{"negative drain", "drain: -1s\ntunnels:\n  - {mode: client, local: '127.0.0.1:1080', remote: a:443}\n", "drain must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "gun.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := Load(path)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("valid config rejected: %v", err)
+				}
+				if len(c.Tunnels) != 1 {
+					t.Fatalf("%d tunnels, want 1", len(c.Tunnels))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
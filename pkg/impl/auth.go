@@ -0,0 +1,148 @@
+package impl
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authMetadataKey = "authorization"
+	bearerScheme    = "Bearer"
+	hmacScheme      = "Gun-HMAC"
+	// hmacMaxSkew bounds the clock difference between client and server
+	hmacMaxSkew = 5 * time.Minute
+)
+
+type userContextKey struct{}
+
+// UserFromContext returns the user a stream was authenticated as.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userContextKey{}).(string)
+	return user, ok
+}
+
+// tokenCredentials attaches a token to every stream. With a user name, only
+// an HMAC of the current time keyed by the token is sent, otherwise the
+// token itself is sent as a bearer token.
+type tokenCredentials struct {
+	user  string
+	token string
+}
+
+// NewTokenCredentials returns per-RPC credentials authenticating streams
+// against a server configured with the same token.
+func NewTokenCredentials(user, token string) credentials.PerRPCCredentials {
+	return tokenCredentials{user: user, token: token}
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if c.user == "" {
+		return map[string]string{authMetadataKey: bearerScheme + " " + c.token}, nil
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return map[string]string{
+		authMetadataKey: fmt.Sprintf("%v %v:%v:%v", hmacScheme, c.user, ts, signTimestamp(c.token, c.user, ts)),
+	}, nil
+}
+
+// RequireTransportSecurity is false, since cleartext mode is meant to be
+// used behind a TLS termination proxy.
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func signTimestamp(token, user, ts string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(user + ":" + ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// healthMethodPrefix starts the methods of the standard health service,
+// which load balancers call without credentials.
+var healthMethodPrefix = "/" + grpc_health_v1.Health_ServiceDesc.ServiceName + "/"
+
+// NewAuthInterceptor returns a stream interceptor accepting only streams
+// authenticated with one of users, a map from user name to token. Streams of
+// the health service are let through, like its unary calls.
+func NewAuthInterceptor(users map[string]string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasPrefix(info.FullMethod, healthMethodPrefix) {
+			return handler(srv, ss)
+		}
+		ctx := ss.Context()
+		user, err := authenticate(ctx, users)
+		if err != nil {
+			log.Printf("rejected stream %v from %v: %v", info.FullMethod, describePeer(ctx), err)
+			return status.Error(codes.Unauthenticated, "authentication failed")
+		}
+		return handler(srv, authenticatedStream{ss, context.WithValue(ctx, userContextKey{}, user)})
+	}
+}
+
+func authenticate(ctx context.Context, users map[string]string) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authMetadataKey)
+	if len(values) == 0 {
+		return "", fmt.Errorf("no credentials")
+	}
+	parts := strings.SplitN(values[0], " ", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed credentials")
+	}
+
+	switch parts[0] {
+	case bearerScheme:
+		for user, token := range users {
+			if subtle.ConstantTimeCompare([]byte(parts[1]), []byte(token)) == 1 {
+				return user, nil
+			}
+		}
+		return "", fmt.Errorf("unknown token")
+	case hmacScheme:
+		fields := strings.Split(parts[1], ":")
+		if len(fields) != 3 {
+			return "", fmt.Errorf("malformed credentials")
+		}
+		user, ts, sig := fields[0], fields[1], fields[2]
+		token, ok := users[user]
+		if !ok {
+			return "", fmt.Errorf("unknown user %v", user)
+		}
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("malformed timestamp")
+		}
+		if skew := time.Since(time.Unix(unix, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+			return "", fmt.Errorf("timestamp of user %v is %v off", user, skew)
+		}
+		if !hmac.Equal([]byte(sig), []byte(signTimestamp(token, user, ts))) {
+			return "", fmt.Errorf("bad signature for user %v", user)
+		}
+		return user, nil
+	}
+	return "", fmt.Errorf("unknown scheme %v", parts[0])
+}
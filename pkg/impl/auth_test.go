@@ -0,0 +1,57 @@
+package impl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthExemptsHealth(t *testing.T) {
+	upstream := udpEcho(t)
+	server := &GunServiceServerImpl{
+		LocalAddr:   "127.0.0.1:0",
+		RemoteAddr:  upstream.String(),
+		Cleartext:   true,
+		ServiceName: "S",
+		Users:       map[string]string{"alice": "secret"},
+	}
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	conn, err := grpc.Dial(server.listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	health := grpc_health_v1.NewHealthClient(conn)
+	if _, err := health.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	watch, err := health.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	// streams of the tunnel still need credentials
+	tun, err := proto.NewGunServiceClient(conn).(proto.GunServiceClientX).TunDatagramCustomName(ctx, "S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tun.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("tunnel without credentials: %v", err)
+	}
+}
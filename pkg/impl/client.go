@@ -2,13 +2,16 @@ package impl
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
 	"time"
 
-	"github.com/Qv2ray/gun/pkg/cert"
 	"github.com/Qv2ray/gun/pkg/proto"
+	"github.com/Qv2ray/gun/pkg/ratelimit"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/codes"
@@ -16,54 +19,180 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+const (
+	// InboundForward forwards local connections as they are
+	InboundForward = "forward"
+	// InboundSocks5 serves a SOCKS5 proxy locally
+	InboundSocks5 = "socks5"
+	// InboundHttp serves an HTTP proxy locally
+	InboundHttp = "http"
+)
+
 type GunServiceClientImpl struct {
-	RemoteAddr  string
-	LocalAddr   string
-	ServerName  string
-	Cleartext   bool
-	UdpSessions *sync.Map
+	RemoteAddr string
+	LocalAddr  string
+	ServerName string
+	Cleartext  bool
+	// CertPath and KeyPath optionally load a client certificate
+	CertPath string
+	KeyPath  string
+	// CAPath is a PEM bundle of CAs trusted besides the system ones
+	CAPath string
+	// PinnedKeys are base64 SHA-256 hashes of SubjectPublicKeyInfo, the
+	// server must present one of them if not empty
+	PinnedKeys []string
+	// Insecure skips verifying the certificate chain of the server
+	Insecure bool
 
 	ServiceName string
-}
+	// Multi uses TunMulti streams, coalescing small writes
+	Multi bool
+	// Target asks the server to forward streams to this host:port instead
+	// of its own remote address
+	Target string
+	// Inbound is the protocol spoken by local connections, InboundForward
+	// when empty
+	Inbound string
+	// Token authenticates streams, sent as HMAC of the time when User is set
+	// and as bearer token otherwise
+	User  string
+	Token string
+	// ConnectTimeout bounds each attempt to connect to the server, defaults
+	// to 5 seconds
+	ConnectTimeout time.Duration
+	// UdpTimeout clears UDP sessions idle for this long, defaults to 2
+	// minutes
+	UdpTimeout time.Duration
+	// MaxUdpSessions bounds the UDP sessions open at once, the least
+	// recently active one is closed to open another beyond. Unlimited if
+	// not set.
+	MaxUdpSessions int
+	// Connections is the number of connections streams are spread over,
+	// picked according to PoolPolicy, PoolLeastStreams by default
+	Connections int
+	PoolPolicy  string
+	// MaxStreamsPerConn makes the client open one more connection when all
+	// of them carry this many streams, if set
+	MaxStreamsPerConn int
+	// Remotes replaces RemoteAddr with several servers, streams go to a
+	// healthy one according to Routing, RoutePriority by default
+	Remotes []Remote
+	Routing string
+	// HealthCheckInterval is how often Remotes are probed, defaults to 10
+	// seconds
+	HealthCheckInterval time.Duration
+	// ReverseTarget makes the client hold a reverse tunnel, connections
+	// accepted by the server on its ReverseAddr are forwarded to this
+	// host:port
+	ReverseTarget string
+	// Resume makes Tun streams resumable: a stream broken with its
+	// connection is opened again, and the local connection kept, for up to
+	// ResumeTimeout, 30 seconds by default
+	Resume        bool
+	ResumeTimeout time.Duration
+	// Shaping pads Tun and TunDatagram streams, the server is asked to
+	// shape its side the same way. It does not apply to Multi.
+	Shaping Shaping
+	// RateLimit and StreamRateLimit bound the bandwidth of all local TCP
+	// connections together and of each one
+	RateLimit       RateLimit
+	StreamRateLimit RateLimit
 
-type ClientUdpSession struct {
-	LastActive time.Time
-	Tun        proto.GunService_TunDatagramClient
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	remotes []*remote
+	// stopReverse ends the control stream of the reverse tunnel
+	stopReverse context.CancelFunc
+	rates       rateBuckets
+	local       net.Listener
+	localUdp    net.PacketConn
+	// udpMu orders the sessions udpLoop and closing sessions open
+	udpMu       sync.Mutex
+	udpSessions *udpTable
+	loops       sync.WaitGroup
+	handlers    sync.WaitGroup
+	done        chan struct{}
+	stopOnce    sync.Once
+
+	// udpAddrUnsupported is set once the server did not support addressed
+	// datagrams
+	udpAddrUnsupported int32
 }
 
-func (g GunServiceClientImpl) Run() {
-	g.UdpSessions = new(sync.Map)
+// Run starts the client and blocks until it is shut down.
+func (g *GunServiceClientImpl) Run() error {
+	if err := g.Start(context.Background()); err != nil {
+		return err
+	}
+	<-g.Done()
+	return nil
+}
 
-	// start TCP local
-	local, err := net.Listen("tcp", g.LocalAddr)
-	if err != nil {
-		log.Fatalf("failed to listen local: %v", err)
+// Start listens on LocalAddr, dials RemoteAddr and serves in background.
+// Without LocalAddr nothing is listened and the client is only used to Dial
+// or to hold a reverse tunnel.
+// Cancelling ctx stops the client immediately, use Shutdown to drain.
+func (g *GunServiceClientImpl) Start(ctx context.Context) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done != nil {
+		return errors.New("client already started")
 	}
-	log.Printf("client listening tcp at %v", g.LocalAddr)
+	g.udpSessions = newUdpTable(sideClient, durationOr(g.UdpTimeout, 2*time.Minute), g.MaxUdpSessions)
 
-	// start UDP local
-	localUdp, err := net.ListenPacket("udp", g.LocalAddr)
-	if err != nil {
-		log.Fatalf("failed to listen udp local: %v", err)
+	defer func() {
+		if err != nil {
+			g.closeTransport()
+		}
+	}()
+
+	switch g.Inbound {
+	case "", InboundForward, InboundSocks5, InboundHttp:
+	default:
+		return fmt.Errorf("unknown inbound %q", g.Inbound)
+	}
+	switch g.PoolPolicy {
+	case "", PoolLeastStreams, PoolRoundRobin:
+	default:
+		return fmt.Errorf("unknown pool policy %q", g.PoolPolicy)
 	}
-	log.Printf("client listening udp at %v", g.LocalAddr)
+	switch g.Routing {
+	case "", RoutePriority, RouteLatency:
+	default:
+		return fmt.Errorf("unknown routing %q", g.Routing)
+	}
+	if err := g.Shaping.Validate(); err != nil {
+		return err
+	}
+	if g.Shaping.enabled() && g.Multi {
+		return errors.New("shaping does not apply to multi streams")
+	}
+	if err := validateRateLimits(g.RateLimit, g.StreamRateLimit); err != nil {
+		return err
+	}
+	g.rates = newRateBuckets(g.RateLimit)
 
-	// select h2/h2c
-	var dialOption grpc.DialOption
-	if !g.Cleartext {
-		roots, err := cert.GetSystemCertPool()
+	if g.LocalAddr != "" {
+		// start TCP local
+		g.local, err = net.Listen("tcp", g.LocalAddr)
 		if err != nil {
-			log.Fatalf("failed to get system certificate pool")
+			return fmt.Errorf("failed to listen local: %w", err)
+		}
+		log.Printf("client listening tcp at %v", g.LocalAddr)
+
+		// start UDP local, proxies relay UDP through their own sockets
+		if g.Inbound == "" || g.Inbound == InboundForward {
+			g.localUdp, err = net.ListenPacket("udp", g.LocalAddr)
+			if err != nil {
+				return fmt.Errorf("failed to listen udp local: %w", err)
+			}
+			log.Printf("client listening udp at %v", g.LocalAddr)
 		}
-		dialOption = grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(roots, g.ServerName))
-	} else {
-		dialOption = grpc.WithInsecure()
 	}
 
-	// dial
-	conn, err := grpc.Dial(
-		g.RemoteAddr,
-		dialOption,
+	dialOptions := []grpc.DialOption{
+		grpc.WithChainStreamInterceptor(metricsClientInterceptor),
 		grpc.WithConnectParams(grpc.ConnectParams{
 			Backoff: backoff.Config{
 				BaseDelay:  500 * time.Millisecond,
@@ -71,186 +200,586 @@ func (g GunServiceClientImpl) Run() {
 				Jitter:     0.2,
 				MaxDelay:   19 * time.Second,
 			},
-			MinConnectTimeout: 5 * time.Second,
+			MinConnectTimeout: durationOr(g.ConnectTimeout, 5*time.Second),
 		}),
-	)
-	if err != nil {
-		log.Fatalf("failed to dial remote: %v", err)
 	}
+	if g.Token != "" {
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(NewTokenCredentials(g.User, g.Token)))
+	}
+
+	remotes := g.Remotes
+	if len(remotes) == 0 {
+		remotes = []Remote{{Addr: g.RemoteAddr}}
+	}
+	for _, r := range remotes {
+		if r.ServerName == "" {
+			r.ServerName = g.ServerName
+		}
+		if r.ServiceName == "" {
+			r.ServiceName = g.ServiceName
+		}
+		rem, err := g.dialRemote(r, dialOptions)
+		if err != nil {
+			return fmt.Errorf("failed to dial remote %v: %w", r.Addr, err)
+		}
+		g.remotes = append(g.remotes, rem)
+	}
+
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	g.done = make(chan struct{})
 
-	client := proto.NewGunServiceClient(conn)
 	// work loops
-	go g.tcpLoop(local, client)
-	go g.scanInactiveSession(2 * time.Minute)
-	g.udpLoop(localUdp, client)
+	if g.local != nil {
+		g.loops.Add(1)
+		go func() {
+			defer g.loops.Done()
+			g.tcpLoop(g.local)
+		}()
+	}
+	if g.localUdp != nil {
+		g.loops.Add(1)
+		go func() {
+			defer g.loops.Done()
+			g.udpLoop(g.localUdp)
+		}()
+	}
+	if g.ReverseTarget != "" {
+		var reverseCtx context.Context
+		reverseCtx, g.stopReverse = context.WithCancel(g.ctx)
+		g.loops.Add(1)
+		go func() {
+			defer g.loops.Done()
+			g.reverseLoop(reverseCtx)
+		}()
+	}
+	if len(g.remotes) > 1 {
+		g.loops.Add(1)
+		go func() {
+			defer g.loops.Done()
+			g.healthLoop(durationOr(g.HealthCheckInterval, 10*time.Second))
+		}()
+	}
+	g.loops.Add(1)
+	go func() {
+		defer g.loops.Done()
+		g.udpSessions.expire(g.ctx)
+	}()
+	go func() {
+		<-g.ctx.Done()
+		g.stop()
+	}()
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits for active streams to
+// finish. Streams still active when ctx expires are closed forcibly.
+func (g *GunServiceClientImpl) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	started := g.done != nil
+	g.mu.Unlock()
+	if !started {
+		return errors.New("client not started")
+	}
+
+	// stop accepting, active streams keep running
+	if g.local != nil {
+		g.local.Close()
+	}
+	if g.localUdp != nil {
+		g.localUdp.Close()
+	}
+	if g.stopReverse != nil {
+		g.stopReverse()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		g.handlers.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	g.cancel()
+	<-g.done
+	return err
+}
+
+// Done returns a channel which is closed when the client has stopped.
+func (g *GunServiceClientImpl) Done() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
+
+// Dial opens a new Tun stream to the server and returns it as a net.Conn.
+// ctx only bounds establishing the stream.
+func (g *GunServiceClientImpl) Dial(ctx context.Context) (net.Conn, error) {
+	return g.DialTarget(ctx, g.Target)
+}
+
+// DialTarget is like Dial, but asks the server to forward the stream to
+// target, which must be allowed by the server.
+func (g *GunServiceClientImpl) DialTarget(ctx context.Context, target string) (net.Conn, error) {
+	g.mu.Lock()
+	started := g.done != nil
+	g.mu.Unlock()
+	if !started {
+		return nil, errors.New("client not started")
+	}
+
+	streamCtx, cancel := context.WithCancel(g.ctx)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	// wait for the connection to be ready, unless another remote may take
+	// the stream
+	var opts []grpc.CallOption
+	if len(g.remotes) == 1 {
+		opts = append(opts, grpc.WaitForReady(true))
+	}
+	tun, err := g.openTun(streamCtx, target, opts...)
+	close(stop)
+	<-stopped
+	if err == nil && streamCtx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	conn := newTunConn(tun, Addr{ServiceName: g.ServiceName}, peerAddr(tun.Context(), g.ServiceName))
+	conn.closeWrite = func() error {
+		return closeSend(tun)
+	}
+	conn.close = cancel
+	return conn, nil
+}
+
+// dialRemote connects to r with the common dialOptions.
+func (g *GunServiceClientImpl) dialRemote(r Remote, dialOptions []grpc.DialOption) (*remote, error) {
+	// select h2/h2c
+	if !g.Cleartext {
+		config, err := g.clientTLSConfig(r.Addr, r.ServerName)
+		if err != nil {
+			return nil, err
+		}
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	} else {
+		dialOptions = append(dialOptions, grpc.WithInsecure())
+	}
+	pool, err := newConnPool(func() (*grpc.ClientConn, error) {
+		return grpc.Dial(r.Addr, dialOptions...)
+	}, g.Connections, g.MaxStreamsPerConn, g.PoolPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return &remote{Remote: r, pool: pool, healthy: true}, nil
+}
+
+// openStream opens a stream with open on the remote picked by Routing,
+// failing over to the next one while they are unavailable.
+func (g *GunServiceClientImpl) openStream(open func(clientX proto.GunServiceClientX, serviceName string) (grpc.ClientStream, error)) (grpc.ClientStream, error) {
+	stream, _, err := g.openStreamOn(open)
+	return stream, err
+}
+
+// openStreamOn is like openStream, and also returns the remote the stream
+// was opened on.
+func (g *GunServiceClientImpl) openStreamOn(open func(clientX proto.GunServiceClientX, serviceName string) (grpc.ClientStream, error)) (grpc.ClientStream, *remote, error) {
+	var err error
+	for range g.remotes {
+		r := g.pickRemote()
+		var stream grpc.ClientStream
+		stream, err = r.pool.openStream(func(clientX proto.GunServiceClientX) (grpc.ClientStream, error) {
+			return open(clientX, r.ServiceName)
+		})
+		if status.Code(err) != codes.Unavailable || len(g.remotes) == 1 {
+			return stream, r, err
+		}
+		r.setHealth(false, 0, err)
+	}
+	return nil, nil, err
+}
+
+// openDatagram opens a TunDatagram stream, forwarded to target by the server
+// if not empty.
+func (g *GunServiceClientImpl) openDatagram(ctx context.Context, target string) (proto.GunService_TunDatagramClient, error) {
+	ctx = g.withShaping(withTarget(ctx, target))
+	stream, err := g.openStream(func(clientX proto.GunServiceClientX, serviceName string) (grpc.ClientStream, error) {
+		return clientX.TunDatagramCustomName(ctx, serviceName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g.shape(stream.(proto.GunService_TunDatagramClient), true), nil
+}
+
+// openTun opens a Tun or TunMulti stream according to Multi, or a resumable
+// one with Resume, forwarded to target by the server if not empty.
+func (g *GunServiceClientImpl) openTun(ctx context.Context, target string, opts ...grpc.CallOption) (tunStream, error) {
+	if g.Resume {
+		return g.openResumable(ctx, target, opts...)
+	}
+	ctx = g.withShaping(withTarget(ctx, target))
+	stream, err := g.openStream(func(clientX proto.GunServiceClientX, serviceName string) (grpc.ClientStream, error) {
+		if g.Multi {
+			return clientX.TunMultiCustomName(ctx, serviceName, opts...)
+		}
+		return clientX.TunCustomName(ctx, serviceName, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if g.Multi {
+		return multiHunkTun{stream.(proto.GunService_TunMultiClient)}, nil
+	}
+	return hunkTun{g.shape(stream.(proto.GunService_TunClient), false)}, nil
+}
+
+func (g *GunServiceClientImpl) stop() {
+	g.stopOnce.Do(func() {
+		g.closeTransport()
+		g.udpSessions.closeAll()
+		g.loops.Wait()
+		g.handlers.Wait()
+		close(g.done)
+	})
+}
+
+func (g *GunServiceClientImpl) closeTransport() {
+	if g.local != nil {
+		g.local.Close()
+	}
+	if g.localUdp != nil {
+		g.localUdp.Close()
+	}
+	for _, r := range g.remotes {
+		r.pool.close()
+	}
 }
 
-func (g GunServiceClientImpl) tcpLoop(local net.Listener, client proto.GunServiceClient) {
-	clientX := client.(proto.GunServiceClientX)
+func (g *GunServiceClientImpl) tcpLoop(local net.Listener) {
 	for {
 		accept, err := local.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
 
 		log.Printf("accepted: %v <-> %v", accept.LocalAddr(), accept.RemoteAddr())
+		g.handlers.Add(1)
 		go func() {
+			defer g.handlers.Done()
 			defer accept.Close()
+			// handlers waiting on the connection return once the client
+			// stops
+			stopClosing := closeOnDone(g.ctx, accept)
+			defer stopClosing()
 
-			// connect rpc
-			tun, err := clientX.TunCustomName(context.Background(), g.ServiceName)
-			if err != nil {
-				log.Printf("failed to create context: %v", err)
-				return
+			switch g.Inbound {
+			case InboundSocks5:
+				g.serveSocks5(accept)
+			case InboundHttp:
+				g.serveHttp(accept)
+			default:
+				// connect rpc
+				tun, err := g.openTun(withSource(g.ctx, accept.RemoteAddr()), g.Target)
+				if err != nil {
+					log.Printf("failed to create context: %v", err)
+					return
+				}
+				g.pipe(accept, tun)
 			}
+		}()
+	}
+}
 
-			var wg sync.WaitGroup
-			wg.Add(2)
-
-			// down link
-			go func() {
-				defer wg.Done()
-				for {
-					recv, err := tun.Recv()
-					if err != nil {
-						if status.Code(err) != codes.Unavailable && status.Code(err) != codes.OutOfRange {
-							log.Printf("remote read conn closed: %v", err)
-						}
-						return
-					}
-					_, err = accept.Write(recv.Data)
-					if err != nil {
-						log.Printf("local write conn closed: %v", err)
-						return
-					}
-				}
-			}()
-
-			// up link
-			go func() {
-				defer wg.Done()
-				buf := make([]byte, 32768)
-				for {
-					nRecv, err := accept.Read(buf)
-					if err != nil {
-						if status.Code(err) != codes.Unavailable && status.Code(err) != codes.OutOfRange {
-							log.Printf("local read conn closed: %v", err)
-						}
-						if err = tun.CloseSend(); err != nil {
-							log.Printf("remote close uplink conn fail: %v", err)
-						}
-						return
-					}
-					err = tun.Send(&proto.Hunk{Data: buf[:nRecv]})
-					if err != nil {
-						log.Printf("remote write conn closed: %v", err)
-						return
-					}
-				}
-			}()
+// closeOnDone closes c once ctx is done, unless stop was called before.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
 
-			wg.Wait()
-		}()
+// limitLocal bounds the rates of a local connection by the limits of all
+// streams and its own.
+func (g *GunServiceClientImpl) limitLocal(local net.Conn) net.Conn {
+	stream := newRateBuckets(g.StreamRateLimit)
+	return limitConn(local,
+		[]*ratelimit.Bucket{g.rates.up, stream.up},
+		[]*ratelimit.Bucket{g.rates.down, stream.down})
+}
+
+// pipe copies between a local connection and a stream until both directions
+// are done.
+func (g *GunServiceClientImpl) pipe(local net.Conn, tun tunStream) {
+	local = g.limitLocal(local)
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// down link
+	go func() {
+		defer wg.Done()
+		if err := copyFromStream(local, tun); err != nil && !isStreamClosed(err) {
+			log.Printf("remote read conn closed: %v", err)
+		}
+		// unblock up link
+		local.Close()
+	}()
+
+	// up link
+	go func() {
+		defer wg.Done()
+		if err := copyToStream(tun, local); err != nil && !isStreamClosed(err) {
+			log.Printf("local read conn closed: %v", err)
+		}
+		if err := closeSend(tun); err != nil {
+			log.Printf("remote close uplink conn fail: %v", err)
+		}
+	}()
+
+	wg.Wait()
+}
+
+// udpQueueSize is how many datagrams may wait for the stream of a client
+// UDP session, more are dropped like on a full socket buffer
+const udpQueueSize = 64
+
+type udpState int
+
+const (
+	// udpOpening sessions queue datagrams until their stream is open
+	udpOpening udpState = iota
+	udpOpen
+	// udpClosed sessions take no more datagrams, the next one from their
+	// address opens a new session
+	udpClosed
+)
+
+// clientUdpSession relays the datagrams of one local address. Its goroutine
+// owns the stream: it opens it, sends what udpLoop queues and ends it, so
+// the stream is never used once closed. The queue is never closed, a
+// closed session refuses datagrams instead.
+type clientUdpSession struct {
+	addr  net.Addr
+	entry *udpSession
+	queue chan []byte
+	// ctx is cancelled on the transition to udpClosed, ending the stream
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	state udpState
+}
+
+func newClientUdpSession(ctx context.Context, addr net.Addr) *clientUdpSession {
+	s := &clientUdpSession{addr: addr, queue: make(chan []byte, udpQueueSize)}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	return s
+}
+
+// open moves the session from udpOpening to udpOpen, and reports false if
+// it was closed meanwhile.
+func (s *clientUdpSession) open() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != udpOpening {
+		return false
+	}
+	s.state = udpOpen
+	return true
+}
+
+// close moves the session to udpClosed.
+func (s *clientUdpSession) close() {
+	s.mu.Lock()
+	s.state = udpClosed
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// deliver queues data for the stream, and reports false if the session is
+// closed. Data is dropped only when the queue is full.
+func (s *clientUdpSession) deliver(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == udpClosed {
+		return false
+	}
+	select {
+	case s.queue <- data:
+		s.entry.touch()
+	default:
 	}
+	return true
 }
 
-func (g GunServiceClientImpl) udpLoop(local net.PacketConn, client proto.GunServiceClient) {
+// udpLoop hands the datagrams received on local to the session of their
+// source.
+func (g *GunServiceClientImpl) udpLoop(local net.PacketConn) {
+	buf := make([]byte, maxHunkSize)
+	var delay time.Duration
 	for {
-		buf := make([]byte, 32768)
-		l, addr, err := local.ReadFrom(buf)
+		n, addr, err := local.ReadFrom(buf)
 		if err != nil {
-			log.Printf("failed to read udp packet: %v", err)
-		}
-		addrStr := addr.String()
-
-		// associate to exist session
-		var session ClientUdpSession
-		s, sessionReused := g.UdpSessions.Load(addrStr)
-		if !sessionReused {
-			// not exist, init new session
-			t, err := client.TunDatagram(context.Background())
-			if err != nil {
-				log.Printf("failed to create context: %v", err)
+			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-
-			session = ClientUdpSession{
-				LastActive: time.Now(),
-				Tun:        t,
+			// back off like net/http does on accept errors, instead of
+			// spinning on a socket which keeps failing
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("failed to read udp packet: %v, retrying in %v", err, delay)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-g.ctx.Done():
+				return
 			}
-			g.UdpSessions.Store(addrStr, session)
-			log.Printf("readfrom: %v <-> %v", local.LocalAddr(), addr)
-		} else {
-			session = s.(ClientUdpSession)
 		}
+		delay = 0
+		g.dispatchUdp(local, addr, append([]byte(nil), buf[:n]...))
+	}
+}
 
-		tun := session.Tun
-		err = tun.Send(&proto.Hunk{Data: buf[:l]})
-		if err != nil {
-			log.Printf("remote write packet conn closed: %v", err)
-			continue
+// dispatchUdp hands data received from addr to the session of addr, opening
+// one if there is none or it is closed.
+func (g *GunServiceClientImpl) dispatchUdp(local net.PacketConn, addr net.Addr, data []byte) {
+	g.udpMu.Lock()
+	defer g.udpMu.Unlock()
+	key := addr.String()
+	entry := g.udpSessions.get(key)
+	if entry != nil && entry.client.deliver(data) {
+		return
+	}
+	if entry != nil {
+		// it is on its way out
+		g.udpSessions.remove(entry)
+	}
+	if g.ctx.Err() != nil {
+		return
+	}
+	s := newClientUdpSession(g.ctx, addr)
+	s.entry = g.udpSessions.add(key, s.close)
+	s.entry.client = s
+	s.deliver(data)
+	log.Printf("readfrom: %v <-> %v", local.LocalAddr(), addr)
+	// callers are loops themselves, so the group is not waited on yet
+	g.loops.Add(1)
+	go g.runUdpSession(s, local)
+}
+
+// runUdpSession relays a client UDP session until it is closed or its
+// stream fails. Udp sessions are not drained but torn down on stop.
+func (g *GunServiceClientImpl) runUdpSession(s *clientUdpSession, local net.PacketConn) {
+	defer g.loops.Done()
+	failed := true
+	defer func() {
+		// leaving the table closes the session, unless it was closed
+		// already
+		g.udpSessions.remove(s.entry)
+		g.requeueUdp(s, local, failed)
+	}()
+
+	tun, err := g.openDatagram(withSource(s.ctx, s.addr), g.Target)
+	if err != nil {
+		if s.ctx.Err() == nil {
+			log.Printf("failed to create context: %v", err)
 		}
-		session.LastActive = time.Now()
+		failed = s.ctx.Err() == nil
+		return
+	}
+	if !s.open() {
+		failed = false
+		return
+	}
 
-		if sessionReused {
-			// there's already a udp down link goroutine, let it handle down link
-			continue
+	// down link
+	recvErr := make(chan error, 1)
+	g.loops.Add(1)
+	go func() {
+		defer g.loops.Done()
+		for {
+			recv, err := tun.Recv()
+			if err == nil {
+				_, err = local.WriteTo(recv.Data, s.addr)
+			}
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			s.entry.touch()
 		}
+	}()
 
-		// down link
-		go func() {
-			for {
-				recv, err := tun.Recv()
-				if err != nil {
-					if status.Code(err) != codes.Unavailable && status.Code(err) != codes.OutOfRange {
-						log.Printf("remote read packet conn closed: %v", err)
-					}
-					// when error, it's obvious
-					// when eof, it means server timed out, new assoc needed
-					g.clearUdpSession(addrStr)
-					return
-				}
-				_, err = local.WriteTo(recv.Data, addr)
-				if err != nil {
-					log.Printf("local write packet conn closed: %v", err)
-					return
+	for {
+		select {
+		case data := <-s.queue:
+			if err := tun.Send(&proto.Hunk{Data: data}); err != nil {
+				// the down link reports why
+				err = <-recvErr
+				if !isStreamClosed(err) {
+					log.Printf("remote write packet conn closed: %v", err)
 				}
-				session.LastActive = time.Now()
+				return
 			}
-		}()
+			s.entry.touch()
+		case err := <-recvErr:
+			// when eof, the server timed the session out
+			if !isStreamClosed(err) {
+				log.Printf("remote read packet conn closed: %v", err)
+			}
+			return
+		case <-s.ctx.Done():
+			failed = false
+			return
+		}
 	}
 }
 
-func (g GunServiceClientImpl) scanInactiveSession(timeout time.Duration) {
-	tick := time.NewTicker(timeout)
+// requeueUdp hands the datagrams left in the queue of a closed session to
+// the session taking over its address. Those of a session whose stream
+// failed are dropped, the next session might fail the same way.
+func (g *GunServiceClientImpl) requeueUdp(s *clientUdpSession, local net.PacketConn, failed bool) {
+	dropped := 0
 	for {
-		<-tick.C
-		needClear := make([]string, 0)
-		now := time.Now()
-		g.UdpSessions.Range(func(key, value interface{}) bool {
-			session := value.(ClientUdpSession)
-			if session.LastActive.Add(timeout).Before(now) {
-				needClear = append(needClear, key.(string))
+		select {
+		case data := <-s.queue:
+			if failed || g.ctx.Err() != nil {
+				dropped++
+			} else {
+				g.dispatchUdp(local, s.addr, data)
 			}
-			return true
-		})
-
-		for _, k := range needClear {
-			g.clearUdpSession(k)
+		default:
+			if dropped > 0 {
+				log.Printf("dropped %d datagrams queued for udp session %v", dropped, s.entry.key)
+			}
+			return
 		}
 	}
 }
-
-func (g GunServiceClientImpl) clearUdpSession(name string) {
-	s, ok := g.UdpSessions.Load(name)
-	if !ok {
-		return
-	}
-	log.Printf("clear udp session %v", name)
-	session := s.(ClientUdpSession)
-	e := session.Tun.CloseSend()
-	if e != nil {
-		log.Printf("error when clear session %v, %v", name, e)
-	}
-	g.UdpSessions.Delete(name)
-}
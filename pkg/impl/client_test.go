@@ -0,0 +1,56 @@
+package impl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientShutdownClosesIdleConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		inbound string
+		// sent before the connection goes idle
+		greeting string
+	}{
+		{"forward", InboundForward, ""},
+		{"socks5 before greeting", InboundSocks5, ""},
+		{"socks5 before request", InboundSocks5, "\x05\x01\x00"},
+		{"http", InboundHttp, "CONNECT "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := tcpEcho(t)
+			g := &GunServiceClientImpl{
+				LocalAddr:   "127.0.0.1:0",
+				RemoteAddr:  startTargetServer(t),
+				Cleartext:   true,
+				ServiceName: "S",
+				Inbound:     tt.inbound,
+				Target:      echo.String(),
+			}
+			if err := g.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			conn, err := net.Dial("tcp", g.local.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(tt.greeting))
+			// the handler is running
+			time.Sleep(50 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if err := g.Shutdown(ctx); err != context.DeadlineExceeded {
+				t.Fatalf("shutdown: %v, want %v", err, context.DeadlineExceeded)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("shutdown took %v", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// udpEcho serves a UDP echo on loopback until the test ends.
+func udpEcho(t *testing.T) net.Addr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr()
+}
+
+// startClient starts a client to remote, and returns the address of its UDP
+// socket, or of its listener if it has none.
+func startClient(t *testing.T, g *GunServiceClientImpl, remote string) net.Addr {
+	t.Helper()
+	g.LocalAddr = "127.0.0.1:0"
+	g.RemoteAddr = remote
+	g.Cleartext = true
+	g.ServiceName = "S"
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		g.Shutdown(ctx)
+	})
+	if g.localUdp == nil {
+		return g.local.Addr()
+	}
+	return g.localUdp.LocalAddr()
+}
+
+// exchange sends msg on conn and reports whether it is echoed back.
+func exchange(conn net.Conn, msg string) bool {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	return err == nil && string(buf[:n]) == msg
+}
+
+// failingServer echoes datagrams, and fails the first stream to echo one
+// right after.
+type failingServer struct {
+	*proto.UnimplementedGunServiceServer
+	streams int32
+	failed  int32
+}
+
+func (s *failingServer) TunDatagram(server proto.GunService_TunDatagramServer) error {
+	atomic.AddInt32(&s.streams, 1)
+	for {
+		hunk, err := server.Recv()
+		if err != nil {
+			return nil
+		}
+		if err := server.Send(&proto.Hunk{Data: hunk.Data}); err != nil {
+			return err
+		}
+		if atomic.CompareAndSwapInt32(&s.failed, 0, 1) {
+			return status.Error(codes.Internal, "stream failed")
+		}
+	}
+}
+
+func TestClientUdpSessionReopensFailedStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &failingServer{}
+	gs := grpc.NewServer()
+	proto.RegisterGunServiceServerX(gs, server, "S")
+	go gs.Serve(listener)
+	defer gs.Stop()
+
+	g := &GunServiceClientImpl{}
+	local := startClient(t, g, listener.Addr().String())
+	conn, err := net.Dial("udp", local.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if !exchange(conn, "first") {
+		t.Fatal("no echo on the first stream")
+	}
+	// the failed session leaves the table
+	deadline := time.Now().Add(2 * time.Second)
+	for g.udpSessions.get(conn.LocalAddr().String()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("failed session still in the table")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !exchange(conn, "second") {
+		t.Fatal("no echo after the stream failed")
+	}
+	if got := atomic.LoadInt32(&server.streams); got != 2 {
+		t.Fatalf("%d streams opened, want 2", got)
+	}
+}
+
+func TestClientUdpSessionDeliver(t *testing.T) {
+	tests := []struct {
+		name       string
+		closeFirst bool
+		datagrams  int
+		wantOk     bool
+		wantQueued int
+	}{
+		{"opening", false, 10, true, 10},
+		{"queue full", false, udpQueueSize + 6, true, udpQueueSize},
+		{"closed", true, 10, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newUdpTable("test-deliver-"+tt.name, time.Minute, 0)
+			s := newClientUdpSession(context.Background(), &net.UDPAddr{})
+			s.entry = table.add("a", s.close)
+			if tt.closeFirst {
+				table.remove(s.entry)
+			}
+			for i := 0; i < tt.datagrams; i++ {
+				if ok := s.deliver([]byte{byte(i)}); ok != tt.wantOk {
+					t.Fatalf("deliver %d: %v, want %v", i, ok, tt.wantOk)
+				}
+			}
+			if got := len(s.queue); got != tt.wantQueued {
+				t.Fatalf("%d queued, want %d", got, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestClientUdpSessionDeliverRacingClose(t *testing.T) {
+	const senders, perSender = 8, 7 // fits the queue
+	for round := 0; round < 50; round++ {
+		table := newUdpTable("test-deliver-race", time.Millisecond, 0)
+		s := newClientUdpSession(context.Background(), &net.UDPAddr{})
+		s.entry = table.add("a", s.close)
+
+		var accepted int32
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perSender; j++ {
+					if s.deliver([]byte{1}) {
+						atomic.AddInt32(&accepted, 1)
+					}
+				}
+			}()
+		}
+		// expire races the senders
+		ctx, cancel := context.WithCancel(context.Background())
+		go table.expire(ctx)
+		time.Sleep(time.Duration(round%4) * time.Millisecond)
+		table.remove(s.entry)
+		wg.Wait()
+		cancel()
+
+		if s.deliver([]byte{1}) {
+			t.Fatal("closed session took a datagram")
+		}
+		// every datagram taken is in the queue, for the session taking
+		// over to send
+		if got := int32(len(s.queue)); got != accepted {
+			t.Fatalf("round %d: %d datagrams accepted, %d queued", round, accepted, got)
+		}
+	}
+}
+
+func TestClientUdpExpiryKeepsDatagrams(t *testing.T) {
+	upstream := udpEcho(t)
+	server := &GunServiceServerImpl{LocalAddr: "127.0.0.1:0", RemoteAddr: upstream.String(), Cleartext: true, ServiceName: "S"}
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	// sessions expire between most datagrams
+	g := &GunServiceClientImpl{UdpTimeout: 20 * time.Millisecond}
+	local := startClient(t, g, server.listener.Addr().String())
+	conn, err := net.Dial("udp", local.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 60; i++ {
+		if !exchange(conn, fmt.Sprint(i)) {
+			t.Fatalf("datagram %d lost", i)
+		}
+		time.Sleep(time.Duration(i%5) * 10 * time.Millisecond)
+	}
+}
+
+func TestClientShutdownWithOpeningSessions(t *testing.T) {
+	// a server which never answers keeps sessions opening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var mu sync.Mutex
+	var accepted []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted = append(accepted, conn)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range accepted {
+			conn.Close()
+		}
+	}()
+	before := runtime.NumGoroutine()
+
+	g := &GunServiceClientImpl{
+		LocalAddr:      "127.0.0.1:0",
+		RemoteAddr:     listener.Addr().String(),
+		Cleartext:      true,
+		ServiceName:    "S",
+		ConnectTimeout: time.Minute,
+	}
+	if err := g.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("udp", g.localUdp.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+		conns = append(conns, conn)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for _, conn := range conns {
+		for g.udpSessions.get(conn.LocalAddr().String()) == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("sessions not opened")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+
+	deadline = time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines left, %d before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingPacketConn fails every read with err, counting them.
+type failingPacketConn struct {
+	net.PacketConn
+	err   error
+	reads int32
+}
+
+func (c *failingPacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return 0, nil, c.err
+}
+
+func TestUdpLoopReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		// the loop is stopped after this long, if it did not return
+		stopAfter time.Duration
+		maxReads  int32
+	}{
+		{"closed", net.ErrClosed, 0, 1},
+		{"failing", errors.New("transient"), 200 * time.Millisecond, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GunServiceClientImpl{}
+			var cancel context.CancelFunc
+			g.ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			conn := &failingPacketConn{err: tt.err}
+			done := make(chan struct{})
+			go func() {
+				g.udpLoop(conn)
+				close(done)
+			}()
+			if tt.stopAfter > 0 {
+				time.Sleep(tt.stopAfter)
+				cancel()
+			}
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("udpLoop did not return")
+			}
+			if reads := atomic.LoadInt32(&conn.reads); reads > tt.maxReads {
+				t.Fatalf("%d reads, want at most %d", reads, tt.maxReads)
+			}
+		})
+	}
+}
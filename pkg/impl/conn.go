@@ -0,0 +1,327 @@
+package impl
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Addr is the address of a gun endpoint, identified by its service name.
+type Addr struct {
+	ServiceName string
+}
+
+func (a Addr) Network() string {
+	return "gun"
+}
+
+func (a Addr) String() string {
+	return a.ServiceName
+}
+
+// peerAddr returns the address of the gRPC peer of a stream.
+func peerAddr(ctx context.Context, serviceName string) net.Addr {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr
+	}
+	return Addr{ServiceName: serviceName}
+}
+
+// tunConn adapts a Tun or TunMulti stream to net.Conn.
+type tunConn struct {
+	stream     tunStream
+	closeWrite func() error
+	close      func()
+	local      net.Addr
+	remote     net.Addr
+
+	recv    chan []byte
+	recvErr error
+	// readMu is held by Read, which consumes pending
+	readMu  sync.Mutex
+	pending []byte
+
+	// writeSem is held while a hunk is being sent, it serializes writes and
+	// half close since gRPC streams do not allow concurrent sends
+	writeSem chan struct{}
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	mu          sync.Mutex
+	writeClosed bool
+	readEOF     bool
+	done        chan struct{}
+	closeOnce   sync.Once
+	finished    chan struct{}
+	finishOnce  sync.Once
+}
+
+func newTunConn(stream tunStream, local, remote net.Addr) *tunConn {
+	c := &tunConn{
+		stream:        stream,
+		local:         local,
+		remote:        remote,
+		recv:          make(chan []byte),
+		writeSem:      make(chan struct{}, 1),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		done:          make(chan struct{}),
+		finished:      make(chan struct{}),
+	}
+	go c.recvLoop()
+	return c
+}
+
+func (c *tunConn) recvLoop() {
+	defer close(c.recv)
+	for {
+		data, err := c.stream.recv()
+		if err != nil {
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				err = io.EOF
+			}
+			c.recvErr = err
+			c.mu.Lock()
+			c.readEOF = true
+			c.mu.Unlock()
+			c.maybeFinish()
+			return
+		}
+		for _, d := range data {
+			if len(d) == 0 {
+				continue
+			}
+			select {
+			case c.recv <- d:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+func (c *tunConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.pending) == 0 {
+		select {
+		case data, ok := <-c.recv:
+			if !ok {
+				if c.recvErr == io.EOF {
+					return 0, io.EOF
+				}
+				return 0, c.opError("read", c.recvErr)
+			}
+			c.pending = data
+		case <-c.readDeadline.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case <-c.done:
+			return 0, c.opError("read", net.ErrClosed)
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *tunConn) Write(b []byte) (int, error) {
+	select {
+	case c.writeSem <- struct{}{}:
+	case <-c.writeDeadline.wait():
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	case <-c.done:
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	c.mu.Lock()
+	writeClosed := c.writeClosed
+	c.mu.Unlock()
+	if writeClosed {
+		<-c.writeSem
+		return 0, c.opError("write", net.ErrClosed)
+	}
+
+	// the send may outlive this call when the deadline fires, so it owns a
+	// copy of b and releases writeSem once finished
+	data := make([]byte, len(b))
+	copy(data, b)
+	chunks := make([][]byte, 0, len(data)/maxHunkSize+1)
+	for len(data) > maxHunkSize {
+		chunks = append(chunks, data[:maxHunkSize])
+		data = data[maxHunkSize:]
+	}
+	chunks = append(chunks, data)
+	errChan := make(chan error, 1)
+	go func() {
+		defer func() { <-c.writeSem }()
+		errChan <- c.stream.send(chunks)
+	}()
+
+	var err error
+	select {
+	case err = <-errChan:
+	case <-c.writeDeadline.wait():
+		err = os.ErrDeadlineExceeded
+	case <-c.done:
+		err = net.ErrClosed
+	}
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+	return len(b), nil
+}
+
+// CloseWrite shuts down the writing side. On the client the stream is
+// half-closed, the server ends the stream once the peer finished writing too.
+func (c *tunConn) CloseWrite() error {
+	select {
+	case c.writeSem <- struct{}{}:
+	case <-c.done:
+		return c.opError("close", net.ErrClosed)
+	}
+	defer func() { <-c.writeSem }()
+
+	c.mu.Lock()
+	if c.writeClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.writeClosed = true
+	c.mu.Unlock()
+
+	var err error
+	if c.closeWrite != nil {
+		err = c.closeWrite()
+	}
+	c.maybeFinish()
+	return err
+}
+
+func (c *tunConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.close != nil {
+			c.close()
+		}
+		c.finish()
+	})
+	return nil
+}
+
+func (c *tunConn) maybeFinish() {
+	c.mu.Lock()
+	both := c.writeClosed && c.readEOF
+	c.mu.Unlock()
+	if both {
+		c.finish()
+	}
+}
+
+func (c *tunConn) finish() {
+	c.finishOnce.Do(func() {
+		close(c.finished)
+	})
+}
+
+func (c *tunConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tunConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tunConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *tunConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *tunConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *tunConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "gun", Source: c.local, Addr: c.remote, Err: err}
+}
+
+// deadline is an abstraction for handling timeouts, the same as the one
+// used by net.Pipe.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set sets the point in time when the deadline will time out.
+// A timeout event is signaled by closing the channel returned by wait.
+// Once a timeout has occurred, the deadline can be refreshed by specifying a
+// t value in the future.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	// time is zero, then there is no deadline
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	// time in the future, setup a timer to cancel in the future
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		d.timer = time.AfterFunc(dur, func() {
+			close(d.cancel)
+		})
+		return
+	}
+
+	// time in the past, so close immediately
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
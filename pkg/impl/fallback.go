@@ -0,0 +1,133 @@
+package impl
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// fallbackHandler serves requests which are not gRPC, from FallbackDir or
+// by proxying to FallbackURL.
+func (g *GunServiceServerImpl) fallbackHandler() (http.Handler, error) {
+	if g.FallbackDir != "" && g.FallbackURL != "" {
+		return nil, errors.New("fallback directory and URL are exclusive")
+	}
+	if g.FallbackDir != "" {
+		return http.FileServer(http.Dir(g.FallbackDir)), nil
+	}
+	u, err := url.Parse(g.FallbackURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid fallback URL %q", g.FallbackURL)
+	}
+	// the Host header is kept, the web server sees the site asked for
+	return httputil.NewSingleHostReverseProxy(u), nil
+}
+
+// newHttpServer builds the HTTP server sharing the listener between gRPC
+// and the fallback, for HTTP/1.1 and HTTP/2 over TLS or HTTP/2 cleartext.
+func (g *GunServiceServerImpl) newHttpServer(config *tls.Config) (*http.Server, error) {
+	fallback, err := g.fallbackHandler()
+	if err != nil {
+		return nil, err
+	}
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.isGrpcRequest(r) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		if !g.addHttpStream() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer g.httpStreams.Done()
+		g.server.ServeHTTP(w, r)
+	})
+
+	server := new(http.Server)
+	if config != nil {
+		config = config.Clone()
+		config.NextProtos = []string{"h2", "http/1.1"}
+		if config.ClientAuth == tls.RequireAndVerifyClientCert {
+			// visitors of the site have no certificate, clients without one
+			// see the site as well
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		server.TLSConfig = config
+	} else {
+		// hijacked connections are unknown to the server, let them go
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: time.Minute})
+	}
+	server.Handler = handler
+	return server, nil
+}
+
+// isGrpcRequest reports whether r goes to the gRPC server, which requires
+// HTTP/2, the gRPC content type and a client certificate if ClientCAPath is
+// set.
+func (g *GunServiceServerImpl) isGrpcRequest(r *http.Request) bool {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		return false
+	}
+	if g.ClientCAPath != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	return true
+}
+
+// serveHttp serves on listener until the HTTP server is closed or drained.
+func (g *GunServiceServerImpl) serveHttp(listener net.Listener) error {
+	var err error
+	if g.httpServer.TLSConfig != nil {
+		err = g.httpServer.ServeTLS(listener, "", "")
+	} else {
+		err = g.httpServer.Serve(listener)
+	}
+	if g.isDraining() {
+		// the listener was closed by drainHttp, streams go on until Shutdown
+		<-g.ctx.Done()
+		return nil
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// addHttpStream counts a gRPC stream served over HTTP, unless the server is
+// draining. The check and the count share drainMu with drainHttp, so no
+// stream is counted once it waits.
+func (g *GunServiceServerImpl) addHttpStream() bool {
+	g.drainMu.Lock()
+	defer g.drainMu.Unlock()
+	if g.draining {
+		return false
+	}
+	g.httpStreams.Add(1)
+	return true
+}
+
+func (g *GunServiceServerImpl) isDraining() bool {
+	g.drainMu.Lock()
+	defer g.drainMu.Unlock()
+	return g.draining
+}
+
+// drainHttp stops accepting connections and gRPC streams, then waits for
+// active streams to finish. http.Server.Shutdown is not used, since it ends
+// the requests carrying streams at once.
+func (g *GunServiceServerImpl) drainHttp() {
+	g.drainMu.Lock()
+	g.draining = true
+	g.drainMu.Unlock()
+	g.listener.Close()
+	g.httpStreams.Wait()
+}
@@ -0,0 +1,145 @@
+package impl
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hopHeaders are removed from plain proxied requests, they only concern the
+// connection to the proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Keep-Alive",
+	"TE",
+	"Trailer",
+	"Upgrade",
+}
+
+// bufferedConn reads through the buffer which parsed the proxy request, so
+// data sent right after it is not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// tunWriter sends every write as a hunk.
+type tunWriter struct {
+	tun tunStream
+}
+
+func (w tunWriter) Write(b []byte) (int, error) {
+	if err := w.tun.send([][]byte{b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// serveHttp handles an HTTP proxy client on an accepted local connection,
+// either tunneling a CONNECT request or forwarding one absolute-URI request.
+func (g *GunServiceClientImpl) serveHttp(local net.Conn) {
+	reader := bufio.NewReader(local)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.Printf("failed to read http proxy request: %v", err)
+		return
+	}
+
+	connect := req.Method == http.MethodConnect
+	var target string
+	if connect {
+		target = withDefaultPort(req.Host, "443")
+	} else {
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			writeHttpError(local, http.StatusBadRequest)
+			return
+		}
+		target = withDefaultPort(req.URL.Host, "80")
+	}
+
+	tun, err := g.openTun(withSource(g.ctx, local.RemoteAddr()), target)
+	if err != nil {
+		log.Printf("failed to create context: %v", err)
+		writeHttpError(local, httpStatusCode(err))
+		return
+	}
+	if err := g.waitDialed(tun); err != nil {
+		log.Printf("failed to connect %v: %v", target, err)
+		writeHttpError(local, httpStatusCode(err))
+		return
+	}
+
+	if connect {
+		if _, err := local.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			closeSend(tun)
+			return
+		}
+		g.pipe(bufferedConn{Conn: local, reader: reader}, tun)
+		return
+	}
+
+	// one request per connection, the stream is bound to its host
+	removeHopHeaders(req.Header)
+	req.Close = true
+	if err := req.Write(tunWriter{tun}); err != nil {
+		log.Printf("remote write conn closed: %v", err)
+		closeSend(tun)
+		return
+	}
+	// nothing more is read from local, requests pipelined after this one
+	// would go to its host. The connection is closed after the response.
+	if err := copyFromStream(g.limitLocal(local), tun); err != nil && !isStreamClosed(err) {
+		log.Printf("remote read conn closed: %v", err)
+	}
+}
+
+// removeHopHeaders removes the headers which only concern the connection to
+// the proxy, including those named by the Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, v := range header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+// httpStatusCode maps the status of a stream which failed to connect, see
+// dialError.
+func httpStatusCode(err error) int {
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func writeHttpError(local net.Conn, code int) {
+	fmt.Fprintf(local, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+}
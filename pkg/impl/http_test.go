@@ -0,0 +1,120 @@
+package impl
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHttpConnectStatus(t *testing.T) {
+	echo := tcpEcho(t)
+	g := &GunServiceClientImpl{Inbound: InboundHttp}
+	proxy := startClient(t, g, startTargetServer(t))
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"allowed", echo.String(), http.StatusOK},
+		{"denied", "10.0.0.1:443", http.StatusForbidden},
+		{"refused", closedPort(t), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxy.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := io.WriteString(conn, "CONNECT "+tt.target+" HTTP/1.1\r\nHost: "+tt.target+"\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %v, want %v", resp.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if !exchange(conn, "hello") {
+				t.Fatal("no echo")
+			}
+		})
+	}
+}
+
+func TestHttpForwardOneRequest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	headers := make(chan http.Header, 2)
+	site := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		headers <- r.Header
+		io.WriteString(w, "hello")
+	})}
+	go site.Serve(listener)
+	defer site.Close()
+
+	g := &GunServiceClientImpl{Inbound: InboundHttp}
+	proxy := startClient(t, g, startTargetServer(t))
+	conn, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	url := "http://" + listener.Addr().String()
+	request := "GET " + url + "/first HTTP/1.1\r\nHost: " + listener.Addr().String() + "\r\n" +
+		"Connection: keep-alive, X-Hop\r\nX-Hop: secret\r\nX-End: kept\r\nProxy-Authorization: Basic Zm9v\r\n\r\n"
+	// pipelined, it would go to the host of the first one
+	request += "GET http://example.com/second HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Fatalf("response %v %q", resp.Status, body)
+	}
+	header := <-headers
+	for _, h := range []string{"X-Hop", "Proxy-Authorization", "Keep-Alive"} {
+		if v := header.Get(h); v != "" {
+			t.Errorf("hop-by-hop header %v forwarded: %q", h, v)
+		}
+	}
+	if v := header.Get("X-End"); v != "kept" {
+		t.Errorf("end-to-end header X-End %q", v)
+	}
+	if strings.Contains(strings.ToLower(header.Get("Connection")), "x-hop") {
+		t.Errorf("Connection header forwarded: %q", header.Get("Connection"))
+	}
+
+	// the proxy closes the connection after the response
+	if rest, err := io.ReadAll(reader); err != nil || len(rest) != 0 {
+		t.Fatalf("after the response: %q, %v", rest, err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("%d requests reached the site, want 1", got)
+	}
+}
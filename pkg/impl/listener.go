@@ -0,0 +1,90 @@
+package impl
+
+import (
+	"net"
+	"sync"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Listener is a net.Listener yielding a net.Conn for each Tun stream of a
+// gun service registered on a gRPC server.
+type Listener struct {
+	proto.UnimplementedGunServiceServer
+
+	serviceName string
+	addr        net.Addr
+	conns       chan *tunConn
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewListener registers the service on s and returns a listener accepting
+// its streams. addr is reported as the local address of every connection,
+// usually the address s is serving on.
+func NewListener(s *grpc.Server, serviceName string, addr net.Addr) *Listener {
+	l := &Listener{
+		serviceName: serviceName,
+		addr:        addr,
+		conns:       make(chan *tunConn),
+		done:        make(chan struct{}),
+	}
+	proto.RegisterGunServiceServerX(s, l, serviceName)
+	return l
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "gun", Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops accepting streams, accepted connections are not affected.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *Listener) Tun(server proto.GunService_TunServer) error {
+	return l.tun(hunkTun{server})
+}
+
+func (l *Listener) TunMulti(server proto.GunService_TunMultiServer) error {
+	return l.tun(multiHunkTun{server})
+}
+
+func (l *Listener) tun(server tunStream) error {
+	ctx := server.Context()
+	conn := newTunConn(server, l.addr, peerAddr(ctx, l.serviceName))
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		// stops its receiving, which would block with nobody reading
+		conn.Close()
+		return status.Error(codes.Unavailable, "listener closed")
+	case <-ctx.Done():
+		conn.Close()
+		return ctx.Err()
+	}
+
+	// returning ends the stream, so wait for the conn to be done with it. A
+	// finished conn is not closed, its reader still gets io.EOF.
+	select {
+	case <-conn.finished:
+	case <-ctx.Done():
+		conn.Close()
+	}
+	return nil
+}
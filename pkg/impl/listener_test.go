@@ -0,0 +1,166 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startListener serves a Listener on loopback, and returns it with its gRPC
+// server and a connection to it.
+func startListener(t *testing.T) (*Listener, *grpc.Server, *grpc.ClientConn) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer()
+	l := NewListener(gs, "S", lis.Addr())
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return l, gs, conn
+}
+
+// acceptWithin accepts a connection from l, failing the test after a second.
+func acceptWithin(t *testing.T, l *Listener) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			t.FailNow()
+		}
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("no connection accepted")
+		return nil
+	}
+}
+
+func TestListenerAccept(t *testing.T) {
+	l, _, conn := startListener(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := proto.NewGunServiceClient(conn).(proto.GunServiceClientX).TunCustomName(ctx, "S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&proto.Hunk{Data: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := acceptWithin(t, l)
+	defer accepted.Close()
+	accepted.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	if _, err := accepted.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if hunk, err := stream.Recv(); err != nil || string(hunk.Data) != "world" {
+		t.Fatalf("received %v, %v", hunk, err)
+	}
+
+	// both sides done writing ends the stream
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accepted.Read(buf); err != io.EOF {
+		t.Fatalf("read after the client finished: %v", err)
+	}
+	if err := accepted.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("stream after both finished: %v", err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	l, _, conn := startListener(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := proto.NewGunServiceClient(conn).(proto.GunServiceClientX)
+
+	accepted, err := client.TunCustomName(ctx, "S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptedConn := acceptWithin(t, l)
+	defer acceptedConn.Close()
+
+	// a stream nobody accepts is refused once the listener closes
+	pending, err := client.TunCustomName(ctx, "S")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pending.Send(&proto.Hunk{Data: []byte("lost")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	l.Close()
+	if _, err := pending.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("stream pending when the listener closed: %v", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept after close: %v", err)
+	}
+
+	// accepted connections are not affected
+	if _, err := acceptedConn.Write([]byte("still")); err != nil {
+		t.Fatal(err)
+	}
+	if hunk, err := accepted.Recv(); err != nil || string(hunk.Data) != "still" {
+		t.Fatalf("received %v, %v", hunk, err)
+	}
+}
+
+func TestListenerShutdown(t *testing.T) {
+	l, gs, conn := startListener(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := proto.NewGunServiceClient(conn).(proto.GunServiceClientX).TunCustomName(ctx, "S"); err != nil {
+		t.Fatal(err)
+	}
+	accepted := acceptWithin(t, l)
+	defer accepted.Close()
+
+	// stopping the server closes connections blocked reading
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := accepted.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	gs.Stop()
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("read succeeded after the server stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read blocked after the server stopped")
+	}
+}
@@ -0,0 +1,178 @@
+package impl
+
+import (
+	"context"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/metrics"
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	sideClient = "client"
+	sideServer = "server"
+
+	// up is from the client to the upstream, down the reverse
+	directionUp   = "up"
+	directionDown = "down"
+)
+
+var (
+	streamsActive = metrics.NewGaugeVec("gun_streams_active",
+		"Streams currently open.", "side", "method")
+	streamsOpened = metrics.NewCounterVec("gun_streams_opened_total",
+		"Streams opened.", "side", "method")
+	streamsClosed = metrics.NewCounterVec("gun_streams_closed_total",
+		"Streams closed, by gRPC status code.", "side", "method", "code")
+	udpSessionsActive = metrics.NewGaugeVec("gun_udp_sessions_active",
+		"UDP sessions currently open.", "side")
+	bytesRelayed = metrics.NewCounterVec("gun_bytes_total",
+		"Payload bytes relayed through streams.", "side", "direction")
+	dialDuration = metrics.NewHistogramVec("gun_dial_duration_seconds",
+		"Time taken to open streams on the client and upstream connections on the server.",
+		metrics.DefaultBuckets, "side")
+	dialFailures = metrics.NewCounterVec("gun_dial_failures_total",
+		"Streams the client failed to open and upstream connections the server failed to make.", "side")
+)
+
+// observeDial records a dial started at start.
+func observeDial(side string, start time.Time, err error) {
+	if err != nil {
+		dialFailures.With(side).Inc()
+		return
+	}
+	dialDuration.With(side).Observe(time.Since(start).Seconds())
+}
+
+// payloadSize returns the number of payload bytes of a message.
+func payloadSize(m interface{}) int {
+	switch m := m.(type) {
+	case *proto.Hunk:
+		return len(m.Data)
+	case *proto.MultiHunk:
+		n := 0
+		for _, d := range m.Data {
+			n += len(d)
+		}
+		return n
+	}
+	return 0
+}
+
+// streamMeter counts one stream in and out, and the bytes it relays.
+type streamMeter struct {
+	side   string
+	method string
+	sent   *metrics.Counter
+	recv   *metrics.Counter
+	once   sync.Once
+}
+
+func newStreamMeter(side, fullMethod string) *streamMeter {
+	// the service name is configurable, only the method is a useful label
+	method := path.Base(fullMethod)
+	sent, recv := directionDown, directionUp
+	if side == sideClient {
+		sent, recv = directionUp, directionDown
+	}
+	streamsOpened.With(side, method).Inc()
+	streamsActive.With(side, method).Inc()
+	return &streamMeter{
+		side:   side,
+		method: method,
+		sent:   bytesRelayed.With(side, sent),
+		recv:   bytesRelayed.With(side, recv),
+	}
+}
+
+// close records the end of the stream, once.
+func (m *streamMeter) close(err error) {
+	m.once.Do(func() {
+		if err == io.EOF {
+			err = nil
+		}
+		streamsActive.With(m.side, m.method).Dec()
+		streamsClosed.With(m.side, m.method, status.Code(err).String()).Inc()
+	})
+}
+
+type meteredServerStream struct {
+	grpc.ServerStream
+	meter *streamMeter
+}
+
+func (s meteredServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.meter.sent.Add(float64(payloadSize(m)))
+	}
+	return err
+}
+
+func (s meteredServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.meter.recv.Add(float64(payloadSize(m)))
+	}
+	return err
+}
+
+// metricsServerInterceptor records the streams served and their status.
+// It comes first, so streams rejected by later interceptors are counted.
+func metricsServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	meter := newStreamMeter(sideServer, info.FullMethod)
+	err := handler(srv, meteredServerStream{ss, meter})
+	meter.close(err)
+	return err
+}
+
+type meteredClientStream struct {
+	grpc.ClientStream
+	meter *streamMeter
+}
+
+func (s meteredClientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err == nil {
+		s.meter.sent.Add(float64(payloadSize(m)))
+	}
+	return err
+}
+
+// RecvMsg also detects the end of the stream, the only point the status of
+// a client stream is known.
+func (s meteredClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.meter.recv.Add(float64(payloadSize(m)))
+	} else {
+		s.meter.close(err)
+	}
+	return err
+}
+
+// metricsClientInterceptor records the streams opened and their status.
+func metricsClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	observeDial(sideClient, start, err)
+	if err != nil {
+		streamsClosed.With(sideClient, path.Base(method), status.Code(err).String()).Inc()
+		return nil, err
+	}
+	meter := newStreamMeter(sideClient, method)
+	// the stream context is done when the stream ends, and ctx too if the
+	// stream was abandoned without reading its status
+	go func() {
+		<-cs.Context().Done()
+		if err := ctx.Err(); err != nil {
+			meter.close(status.FromContextError(err).Err())
+		}
+	}()
+	return meteredClientStream{cs, meter}, nil
+}
@@ -0,0 +1,160 @@
+package impl
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// udpAddrMetadataKey asks for an addressed TunDatagram stream, on which
+// every hunk carries the peer of its datagram. The server answers with its
+// UdpNat in the header right away.
+const udpAddrMetadataKey = "gun-udp-addr"
+
+const (
+	// NatPortRestricted only passes replies from the addresses datagrams
+	// were sent to
+	NatPortRestricted = "port-restricted"
+	// NatRestricted passes replies from any port of the hosts datagrams were
+	// sent to
+	NatRestricted = "restricted"
+	// NatFullCone passes replies from anyone
+	NatFullCone = "full-cone"
+)
+
+// maxUdpPeers bounds the peers remembered for one UDP session, they are
+// forgotten all at once beyond
+const maxUdpPeers = 1024
+
+var errUdpAddrUnsupported = status.Error(codes.Unimplemented, "server does not support addressed datagrams")
+
+// natFilter passes the datagrams received on the socket of a UDP session
+// according to the NAT policy.
+type natFilter struct {
+	policy string
+	mu     sync.Mutex
+	peers  map[string]struct{}
+}
+
+func newNatFilter(policy string) *natFilter {
+	return &natFilter{policy: policy, peers: make(map[string]struct{})}
+}
+
+func (f *natFilter) key(addr *net.UDPAddr) string {
+	if f.policy == NatRestricted {
+		return addr.IP.String()
+	}
+	return addr.String()
+}
+
+// sent records addr as a destination of the session.
+func (f *natFilter) sent(addr *net.UDPAddr) {
+	if f.policy == NatFullCone {
+		return
+	}
+	key := f.key(addr)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.peers[key]; ok {
+		return
+	}
+	if len(f.peers) >= maxUdpPeers {
+		f.peers = make(map[string]struct{})
+	}
+	f.peers[key] = struct{}{}
+}
+
+// allows reports whether a datagram from addr is passed to the client.
+func (f *natFilter) allows(addr net.Addr) bool {
+	if f.policy == NatFullCone {
+		return true
+	}
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok = f.peers[f.key(a)]
+	return ok
+}
+
+// udpDestinations resolves the destinations of the datagrams of an
+// addressed stream against the target policy, remembering the answers.
+type udpDestinations struct {
+	targets targetPolicy
+	// resolved is nil for denied destinations
+	resolved map[string]*net.UDPAddr
+}
+
+func newUdpDestinations(targets targetPolicy) *udpDestinations {
+	return &udpDestinations{targets: targets, resolved: make(map[string]*net.UDPAddr)}
+}
+
+// resolve returns the address to send to, or nil if target is not allowed.
+func (d *udpDestinations) resolve(ctx context.Context, target string) *net.UDPAddr {
+	if addr, ok := d.resolved[target]; ok {
+		return addr
+	}
+	if len(d.resolved) >= maxUdpPeers {
+		d.resolved = make(map[string]*net.UDPAddr)
+	}
+	var addr *net.UDPAddr
+	if allowed, err := d.targets.resolve(ctx, target); err != nil {
+		log.Printf("rejected datagram target %v: %v", target, err)
+	} else if addr, err = net.ResolveUDPAddr("udp", allowed); err != nil {
+		log.Printf("failed to resolve datagram target %v: %v", target, err)
+	}
+	d.resolved[target] = addr
+	return addr
+}
+
+// addressedFromContext reports whether the client asked for an addressed
+// stream.
+func addressedFromContext(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return len(md.Get(udpAddrMetadataKey)) > 0
+}
+
+// openAddressedDatagram opens an addressed TunDatagram stream, which is
+// closed by calling the returned cancel or cancelling ctx. On failure the
+// stream is closed already. Servers answering that they do not support it
+// fail with errUdpAddrUnsupported, and are not asked again. Servers not
+// answering in time are asked again for the next stream.
+func (g *GunServiceClientImpl) openAddressedDatagram(ctx context.Context) (proto.GunService_TunDatagramClient, context.CancelFunc, error) {
+	if atomic.LoadInt32(&g.udpAddrUnsupported) != 0 {
+		return nil, nil, errUdpAddrUnsupported
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	tun, err := g.openDatagram(metadata.AppendToOutgoingContext(ctx, udpAddrMetadataKey, "1"), "")
+	if err == nil {
+		// older servers stay silent until a reply arrives
+		var md metadata.MD
+		md, err = waitHeader(tun, durationOr(g.ConnectTimeout, 5*time.Second))
+		if err == nil && len(md.Get(udpAddrMetadataKey)) == 0 {
+			// errors come without headers, a reply without it comes from an
+			// older server
+			if _, err = tun.Recv(); err == nil {
+				err = errUdpAddrUnsupported
+			}
+		}
+	}
+	if err != nil {
+		cancel()
+		if status.Code(err) == codes.Unimplemented {
+			atomic.StoreInt32(&g.udpAddrUnsupported, 1)
+			log.Printf("server does not support addressed datagrams, sending each destination its own stream")
+			err = errUdpAddrUnsupported
+		}
+		return nil, nil, err
+	}
+	return tun, cancel, nil
+}
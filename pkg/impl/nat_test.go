@@ -0,0 +1,104 @@
+package impl
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// addressedServer answers TunDatagram streams with answer, and reports the
+// end of each stream on ended.
+type addressedServer struct {
+	*proto.UnimplementedGunServiceServer
+	answer  func(server proto.GunService_TunDatagramServer) error
+	streams int32
+	ended   chan struct{}
+}
+
+func (s *addressedServer) TunDatagram(server proto.GunService_TunDatagramServer) error {
+	atomic.AddInt32(&s.streams, 1)
+	defer func() { s.ended <- struct{}{} }()
+	return s.answer(server)
+}
+
+func TestOpenAddressedDatagram(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  func(server proto.GunService_TunDatagramServer) error
+		wantErr error
+		// the client does not ask again
+		wantLatched bool
+	}{
+		{"supported", func(server proto.GunService_TunDatagramServer) error {
+			server.SendHeader(metadata.Pairs(udpAddrMetadataKey, NatPortRestricted))
+			<-server.Context().Done()
+			return nil
+		}, nil, false},
+		{"silent", func(server proto.GunService_TunDatagramServer) error {
+			<-server.Context().Done()
+			return nil
+		}, errNoAnswer, false},
+		{"failing", func(server proto.GunService_TunDatagramServer) error {
+			return status.Error(codes.Unavailable, "upstream down")
+		}, status.Error(codes.Unavailable, "upstream down"), false},
+		{"unimplemented", func(server proto.GunService_TunDatagramServer) error {
+			return status.Error(codes.Unimplemented, "unknown method")
+		}, errUdpAddrUnsupported, true},
+		{"older server replying", func(server proto.GunService_TunDatagramServer) error {
+			server.Send(&proto.Hunk{Data: []byte("reply")})
+			<-server.Context().Done()
+			return nil
+		}, errUdpAddrUnsupported, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &addressedServer{answer: tt.answer, ended: make(chan struct{}, 2)}
+			gs := grpc.NewServer()
+			proto.RegisterGunServiceServerX(gs, server, "S")
+			go gs.Serve(listener)
+			defer gs.Stop()
+
+			g := &GunServiceClientImpl{ConnectTimeout: 200 * time.Millisecond}
+			startClient(t, g, listener.Addr().String())
+
+			for i := 0; i < 2; i++ {
+				tun, cancel, err := g.openAddressedDatagram(g.ctx)
+				if err != nil && err.Error() != tt.wantErr.Error() || err == nil && tt.wantErr != nil {
+					t.Fatalf("open %d: %v, want %v", i, err, tt.wantErr)
+				}
+				if err == nil {
+					if tun == nil || cancel == nil {
+						t.Fatal("no stream")
+					}
+					cancel()
+				}
+				// the stream is closed once done with or failed
+				if i == 0 || !tt.wantLatched {
+					select {
+					case <-server.ended:
+					case <-time.After(2 * time.Second):
+						t.Fatalf("open %d: stream left open", i)
+					}
+				}
+			}
+			want := int32(2)
+			if tt.wantLatched {
+				want = 1
+			}
+			if got := atomic.LoadInt32(&server.streams); got != want {
+				t.Fatalf("%d streams opened, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package impl
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	// PoolLeastStreams opens streams on the connection carrying the fewest
+	PoolLeastStreams = "least-streams"
+	// PoolRoundRobin opens streams on each connection in turn
+	PoolRoundRobin = "round-robin"
+)
+
+var errPoolClosed = errors.New("connection pool closed")
+
+// connPool spreads streams over several connections to the server, so one
+// HTTP/2 flow-control window or per-connection stream limit is not shared
+// by every session.
+type connPool struct {
+	dial func() (*grpc.ClientConn, error)
+	// size connections are kept open, more are dialed while all of them
+	// carry maxStreams streams
+	size       int
+	maxStreams int
+	roundRobin bool
+
+	mu     sync.Mutex
+	conns  []*pooledConn
+	next   int
+	closed bool
+}
+
+type pooledConn struct {
+	conn    *grpc.ClientConn
+	streams int
+}
+
+func newConnPool(dial func() (*grpc.ClientConn, error), size, maxStreams int, policy string) (*connPool, error) {
+	if size < 1 {
+		size = 1
+	}
+	p := &connPool{
+		dial:       dial,
+		size:       size,
+		maxStreams: maxStreams,
+		roundRobin: policy == PoolRoundRobin,
+	}
+	for i := 0; i < size; i++ {
+		conn, err := dial()
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.conns = append(p.conns, &pooledConn{conn: conn})
+	}
+	return p, nil
+}
+
+// pick chooses the connection of a new stream and counts the stream on it.
+// The stream must be handed to track, or the connection to release if it
+// failed to open.
+func (p *connPool) pick() (*pooledConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errPoolClosed
+	}
+
+	var picked *pooledConn
+	if p.roundRobin {
+		for i := range p.conns {
+			pc := p.conns[(p.next+i)%len(p.conns)]
+			if p.hasRoom(pc) {
+				picked = pc
+				p.next = (p.next + i + 1) % len(p.conns)
+				break
+			}
+		}
+	} else {
+		for _, pc := range p.conns {
+			if p.hasRoom(pc) && (picked == nil || pc.streams < picked.streams) {
+				picked = pc
+			}
+		}
+	}
+
+	if picked == nil {
+		// every connection is full
+		conn, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+		picked = &pooledConn{conn: conn}
+		p.conns = append(p.conns, picked)
+	}
+	picked.streams++
+	return picked, nil
+}
+
+func (p *connPool) hasRoom(pc *pooledConn) bool {
+	return p.maxStreams <= 0 || pc.streams < p.maxStreams
+}
+
+// track releases the connection of stream once it ends.
+func (p *connPool) track(pc *pooledConn, stream grpc.ClientStream) {
+	go func() {
+		// the context of a client stream is done when it finishes
+		<-stream.Context().Done()
+		p.release(pc)
+	}()
+}
+
+// release uncounts a stream. While the pool is beyond its size, the newest
+// idle connection is closed, never the first one.
+func (p *connPool) release(pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.streams--
+	if pc.streams > 0 || len(p.conns) <= p.size {
+		return
+	}
+	for i := len(p.conns) - 1; i > 0; i-- {
+		if c := p.conns[i]; c.streams == 0 {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// primary returns the first connection, which is never closed before the
+// pool.
+func (p *connPool) primary() *grpc.ClientConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.conns) == 0 {
+		return nil
+	}
+	return p.conns[0].conn
+}
+
+// state returns the state of the primary connection.
+func (p *connPool) state() connectivity.State {
+	conn := p.primary()
+	if conn == nil {
+		return connectivity.Shutdown
+	}
+	return conn.GetState()
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, pc := range p.conns {
+		pc.conn.Close()
+	}
+	p.conns = nil
+}
+
+// openStream opens a stream with open on a connection of the pool.
+func (p *connPool) openStream(open func(proto.GunServiceClientX) (grpc.ClientStream, error)) (grpc.ClientStream, error) {
+	pc, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := open(proto.NewGunServiceClient(pc.conn).(proto.GunServiceClientX))
+	if err != nil {
+		p.release(pc)
+		return nil, err
+	}
+	p.track(pc, stream)
+	return stream, nil
+}
@@ -0,0 +1,136 @@
+package impl
+
+import (
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// testPool returns a pool of connections which are never used, grpc dials
+// lazily.
+func testPool(t *testing.T, size, maxStreams int, policy string) *connPool {
+	t.Helper()
+	p, err := newConnPool(func() (*grpc.ClientConn, error) {
+		return grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+	}, size, maxStreams, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.close)
+	return p
+}
+
+// indexOf returns the position of pc in the pool, or -1.
+func indexOf(p *connPool, pc *pooledConn) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == pc {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPoolPick(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		maxStreams int
+		policy     string
+		picks      int
+		// want is the position of the connection of each pick
+		want []int
+	}{
+		{"least streams", 3, 0, PoolLeastStreams, 6, []int{0, 1, 2, 0, 1, 2}},
+		{"round robin", 3, 0, PoolRoundRobin, 4, []int{0, 1, 2, 0}},
+		{"grows when full", 1, 2, PoolLeastStreams, 5, []int{0, 0, 1, 1, 2}},
+		{"round robin grows when full", 2, 1, PoolRoundRobin, 3, []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPool(t, tt.size, tt.maxStreams, tt.policy)
+			for i := 0; i < tt.picks; i++ {
+				pc, err := p.pick()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := indexOf(p, pc); got != tt.want[i] {
+					t.Fatalf("pick %d on connection %d, want %d", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPoolReleaseKeepsPrimary(t *testing.T) {
+	p := testPool(t, 1, 1, PoolLeastStreams)
+	first, err := p.pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := p.primary()
+	if indexOf(p, second) != 1 {
+		t.Fatal("no connection added when the first is full")
+	}
+
+	// the first connection going idle first is kept, health checks use it
+	p.release(first)
+	if p.primary() != primary || primary.GetState() == connectivity.Shutdown {
+		t.Fatal("primary connection closed")
+	}
+	if indexOf(p, second) != 1 {
+		t.Fatal("busy connection dropped")
+	}
+
+	p.release(second)
+	if indexOf(p, second) != -1 || second.conn.GetState() != connectivity.Shutdown {
+		t.Fatal("idle connection beyond the size of the pool kept")
+	}
+	if p.primary() != primary || primary.GetState() == connectivity.Shutdown {
+		t.Fatal("primary connection closed")
+	}
+}
+
+func TestPoolReleaseNewestIdle(t *testing.T) {
+	p := testPool(t, 1, 1, PoolLeastStreams)
+	var picked []*pooledConn
+	for i := 0; i < 3; i++ {
+		pc, err := p.pick()
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked = append(picked, pc)
+	}
+
+	// the middle one stays while the pool is beyond its size, until released
+	p.release(picked[2])
+	if indexOf(p, picked[2]) != -1 || indexOf(p, picked[1]) != 1 {
+		t.Fatal("want the idle connection closed and the busy one kept")
+	}
+	p.release(picked[0])
+	if indexOf(p, picked[0]) != 0 || indexOf(p, picked[1]) != 1 {
+		t.Fatal("want the primary and the busy connection kept")
+	}
+	p.release(picked[1])
+	if indexOf(p, picked[1]) != -1 || indexOf(p, picked[0]) != 0 {
+		t.Fatal("want only the primary connection left")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p := testPool(t, 2, 0, PoolLeastStreams)
+	primary := p.primary()
+	p.close()
+	if _, err := p.pick(); err != errPoolClosed {
+		t.Fatalf("pick after close: %v", err)
+	}
+	if p.state() != connectivity.Shutdown || primary.GetState() != connectivity.Shutdown {
+		t.Fatal("connections open after close")
+	}
+}
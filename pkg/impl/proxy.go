@@ -0,0 +1,67 @@
+package impl
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// sourceMetadataKey carries the address of the local client of a stream,
+// for the server to pass on in PROXY protocol headers.
+const sourceMetadataKey = "gun-source"
+
+// withSource attaches the address of the local client to the outgoing
+// stream context.
+func withSource(ctx context.Context, addr net.Addr) context.Context {
+	if addr == nil {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, sourceMetadataKey, addr.String())
+}
+
+// streamSource returns the address of the original client of a stream. The
+// address forwarded by the gun client is used if the stream is
+// authenticated, by a token or a client certificate, and it is not a
+// loopback one, which says nothing about the client. Otherwise that of the
+// gun client itself is used, anyone could claim any address.
+func streamSource(ctx context.Context) net.Addr {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && authenticated(ctx) {
+		if v := md.Get(sourceMetadataKey); len(v) > 0 {
+			if addr := parseIPAddr(v[0]); addr != nil && !addr.IP.IsLoopback() {
+				return addr
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		// peers of the fallback HTTP server only have a string address
+		if addr := parseIPAddr(p.Addr.String()); addr != nil {
+			return addr
+		}
+	}
+	return nil
+}
+
+// parseIPAddr parses an ip:port address, nil if it is not one.
+func parseIPAddr(s string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
+
+// udpAddr returns addr as the UDP address of the same IP and port.
+func udpAddr(addr net.Addr) net.Addr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	}
+	return addr
+}
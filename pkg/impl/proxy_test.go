@@ -0,0 +1,49 @@
+package impl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestStreamSource(t *testing.T) {
+	gunClient := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000}
+	verified := credentials.TLSInfo{State: tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{&x509.Certificate{}}},
+	}}
+	tests := []struct {
+		name     string
+		source   string
+		user     string
+		authInfo credentials.AuthInfo
+		want     string
+	}{
+		{"anonymous", "192.0.2.1:1234", "", nil, gunClient.String()},
+		{"unverified TLS", "192.0.2.1:1234", "", credentials.TLSInfo{}, gunClient.String()},
+		{"user", "192.0.2.1:1234", "alice", nil, "192.0.2.1:1234"},
+		{"client certificate", "192.0.2.1:1234", "", verified, "192.0.2.1:1234"},
+		{"user without source", "", "alice", nil, gunClient.String()},
+		{"user with loopback source", "127.0.0.1:1234", "alice", nil, gunClient.String()},
+		{"user with malformed source", "192.0.2.1", "alice", nil, gunClient.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: gunClient, AuthInfo: tt.authInfo})
+			if tt.source != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(sourceMetadataKey, tt.source))
+			}
+			if tt.user != "" {
+				ctx = context.WithValue(ctx, userContextKey{}, tt.user)
+			}
+			if got := streamSource(ctx); got == nil || got.String() != tt.want {
+				t.Fatalf("source %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
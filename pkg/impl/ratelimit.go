@@ -0,0 +1,124 @@
+package impl
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Qv2ray/gun/pkg/ratelimit"
+)
+
+// RateLimit bounds bandwidth in bytes per second, zero for no limit. Up is
+// the direction from the client to the server.
+type RateLimit struct {
+	Up   int64
+	Down int64
+}
+
+// ParseRateLimit parses a rate like "10M" for both directions, or a pair
+// like "1M:10M" for up and down, see ratelimit.ParseRate.
+func ParseRateLimit(s string) (RateLimit, error) {
+	up, down := s, s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		up, down = s[:i], s[i+1:]
+	}
+	var l RateLimit
+	var err error
+	if l.Up, err = ratelimit.ParseRate(up); err != nil {
+		return RateLimit{}, err
+	}
+	if l.Down, err = ratelimit.ParseRate(down); err != nil {
+		return RateLimit{}, err
+	}
+	return l, nil
+}
+
+// rateBuckets are the buckets of a RateLimit, nil in unlimited directions.
+type rateBuckets struct {
+	up   *ratelimit.Bucket
+	down *ratelimit.Bucket
+}
+
+func newRateBuckets(l RateLimit) rateBuckets {
+	return rateBuckets{
+		up:   ratelimit.New(l.Up, rateBurst(l.Up)),
+		down: ratelimit.New(l.Down, rateBurst(l.Down)),
+	}
+}
+
+// rateBurst lets a tenth of a second of data pass at once, and at least a
+// few hunks so slow limits do not split every read.
+func rateBurst(rate int64) int64 {
+	if burst := rate / 10; burst > 4*maxHunkSize {
+		return burst
+	}
+	return 4 * maxHunkSize
+}
+
+// limitedConn bounds the bandwidth of a connection. Reads wait on the read
+// buckets once done, which holds up the next one, and writes wait on the
+// write buckets first.
+type limitedConn struct {
+	net.Conn
+	read  []*ratelimit.Bucket
+	write []*ratelimit.Bucket
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// limitConn wraps conn to wait on the buckets which are not nil.
+func limitConn(conn net.Conn, read, write []*ratelimit.Bucket) net.Conn {
+	read, write = nonNil(read), nonNil(write)
+	if len(read) == 0 && len(write) == 0 {
+		return conn
+	}
+	return &limitedConn{Conn: conn, read: read, write: write, closed: make(chan struct{})}
+}
+
+func nonNil(buckets []*ratelimit.Bucket) []*ratelimit.Bucket {
+	var out []*ratelimit.Bucket
+	for _, b := range buckets {
+		if b != nil {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && ratelimit.Wait(c.closed, n, c.read...) != nil && err == nil {
+		err = net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if ratelimit.Wait(c.closed, len(b), c.write...) != nil {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// validateRateLimits checks that no limit is negative.
+func validateRateLimits(limits ...RateLimit) error {
+	for _, l := range limits {
+		if l.Up < 0 || l.Down < 0 {
+			return errors.New("rate limits must not be negative")
+		}
+	}
+	return nil
+}
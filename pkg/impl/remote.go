@@ -0,0 +1,144 @@
+package impl
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// RoutePriority opens streams on the healthy remote of lowest Priority
+	RoutePriority = "priority"
+	// RouteLatency opens streams on the healthy remote answering health
+	// checks fastest
+	RouteLatency = "latency"
+)
+
+// Remote is one of the servers of a client. ServerName and ServiceName
+// default to those of the client.
+type Remote struct {
+	Addr        string
+	ServerName  string
+	ServiceName string
+	// Priority orders remotes with RoutePriority, lower first
+	Priority int
+}
+
+// remote is a Remote with its connections and health.
+type remote struct {
+	Remote
+	pool *connPool
+
+	mu      sync.Mutex
+	healthy bool
+	latency time.Duration
+}
+
+// usable reports whether new streams may go to r. Failing connections are
+// noticed before the next health check.
+func (r *remote) usable() bool {
+	r.mu.Lock()
+	healthy := r.healthy
+	r.mu.Unlock()
+	return healthy && r.pool.state() != connectivity.TransientFailure
+}
+
+func (r *remote) setHealth(healthy bool, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if healthy != r.healthy {
+		if healthy {
+			log.Printf("remote %v is up", r.Addr)
+		} else {
+			log.Printf("remote %v is down: %v", r.Addr, err)
+		}
+	}
+	r.healthy = healthy
+	if !healthy {
+		return
+	}
+	// smooth the latency, one slow answer should not move every stream
+	if r.latency == 0 {
+		r.latency = latency
+	} else {
+		r.latency = (r.latency*3 + latency) / 4
+	}
+}
+
+// probe checks the health of r with the standard health service. Servers
+// without it are alive as long as they answer.
+func (r *remote) probe(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := grpc_health_v1.NewHealthClient(r.pool.primary()).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	latency := time.Since(start)
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		r.setHealth(true, latency, nil)
+	case err != nil:
+		r.setHealth(false, 0, err)
+	case resp.Status != grpc_health_v1.HealthCheckResponse_SERVING:
+		r.setHealth(false, 0, status.Errorf(codes.Unavailable, "server is %v", resp.Status))
+	default:
+		r.setHealth(true, latency, nil)
+	}
+}
+
+// pickRemote chooses the remote of a new stream. When none is usable, the
+// first one by the routing policy is tried anyway.
+func (g *GunServiceClientImpl) pickRemote() *remote {
+	var best *remote
+	bestUsable := false
+	for _, r := range g.remotes {
+		usable := r.usable()
+		if best == nil || usable && !bestUsable || usable == bestUsable && g.prefer(r, best) {
+			best, bestUsable = r, usable
+		}
+	}
+	return best
+}
+
+// prefer reports whether a comes before b by the routing policy.
+func (g *GunServiceClientImpl) prefer(a, b *remote) bool {
+	if g.Routing == RouteLatency {
+		a.mu.Lock()
+		la := a.latency
+		a.mu.Unlock()
+		b.mu.Lock()
+		lb := b.latency
+		b.mu.Unlock()
+		// remotes never measured come last
+		return la != 0 && (lb == 0 || la < lb)
+	}
+	return a.Priority < b.Priority
+}
+
+// healthLoop probes every remote each interval.
+func (g *GunServiceClientImpl) healthLoop(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, r := range g.remotes {
+			wg.Add(1)
+			go func(r *remote) {
+				defer wg.Done()
+				r.probe(g.ctx, interval)
+			}(r)
+		}
+		wg.Wait()
+
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
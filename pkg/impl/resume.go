@@ -0,0 +1,824 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// sessionMetadataKey carries the id of the session of a resumable Tun
+	// stream
+	sessionMetadataKey = "gun-session"
+	// resumeMetadataKey carries the number of bytes received by the peer
+	// resuming a session, sent by the client to resume and by the server
+	// to answer
+	resumeMetadataKey = "gun-resume"
+
+	// resumeBufferSize bounds the data kept until the peer acknowledges it,
+	// sending blocks beyond
+	resumeBufferSize = 1 << 20
+	// resumeAckInterval is how much data is received before it is
+	// acknowledged, unless data going the other way carries the ack first
+	resumeAckInterval = 64 << 10
+)
+
+var errSessionExpired = errors.New("session expired")
+
+// resumeBuffer keeps the data sent on a resumable stream until the peer
+// acknowledges it, and counts the data received. Its methods must be called
+// with mu held.
+type resumeBuffer struct {
+	mu sync.Mutex
+	// changed is broadcast when room is made in the buffer, the stream is
+	// replaced or the session ends
+	changed  *sync.Cond
+	unacked  []byte
+	base     uint64
+	received uint64
+	// acked is the received count last told to the peer, ackDue asks
+	// ackLoop to tell it again
+	acked  uint64
+	ackDue chan struct{}
+	err    error
+	// done is closed when the session ends
+	done chan struct{}
+}
+
+func (b *resumeBuffer) init() {
+	b.changed = sync.NewCond(&b.mu)
+	b.ackDue = make(chan struct{}, 1)
+	b.done = make(chan struct{})
+}
+
+// waitRoom blocks while the buffer is full.
+func (b *resumeBuffer) waitRoom() error {
+	for len(b.unacked) >= resumeBufferSize && b.err == nil {
+		b.changed.Wait()
+	}
+	return b.err
+}
+
+// push buffers data about to be sent, and returns the ack to send with it.
+func (b *resumeBuffer) push(data []byte) uint64 {
+	b.unacked = append(b.unacked, data...)
+	b.acked = b.received
+	return b.received
+}
+
+// ack drops the data the peer has received.
+func (b *resumeBuffer) ack(n uint64) {
+	if n <= b.base || n > b.base+uint64(len(b.unacked)) {
+		return
+	}
+	b.unacked = b.unacked[n-b.base:]
+	b.base = n
+	b.changed.Broadcast()
+}
+
+// receive counts n bytes received, and asks for an ack if it is time to tell
+// the peer.
+func (b *resumeBuffer) receive(n int) {
+	b.received += uint64(n)
+	if b.received-b.acked >= resumeAckInterval {
+		b.ackNow()
+	}
+}
+
+// ackNow asks ackLoop to tell the peer the count received.
+func (b *resumeBuffer) ackNow() {
+	select {
+	case b.ackDue <- struct{}{}:
+	default:
+	}
+}
+
+// rewind returns the data to send again to a peer which received n bytes.
+func (b *resumeBuffer) rewind(n uint64) ([]byte, error) {
+	if n < b.base || n > b.base+uint64(len(b.unacked)) {
+		return nil, fmt.Errorf("peer resumes at byte %v, bytes %v to %v are buffered", n, b.base, b.base+uint64(len(b.unacked)))
+	}
+	b.ack(n)
+	return b.unacked, nil
+}
+
+// fail ends the session with err.
+func (b *resumeBuffer) fail(err error) {
+	if b.err == nil {
+		b.err = err
+		close(b.done)
+	}
+	b.changed.Broadcast()
+}
+
+// ackLoop sends the acks asked for by receive on their own, so a send
+// blocked by flow control never holds up receiving. stream returns the
+// current stream or nil, it is called with mu held.
+func (b *resumeBuffer) ackLoop(sendMu *sync.Mutex, stream func() hunkStream) {
+	for {
+		select {
+		case <-b.ackDue:
+		case <-b.done:
+			return
+		}
+		sendMu.Lock()
+		b.mu.Lock()
+		s := stream()
+		ack := b.received
+		b.acked = ack
+		b.mu.Unlock()
+		if s != nil {
+			// failures are noticed by the next send or receive
+			s.Send(&proto.Hunk{Ack: ack})
+		}
+		sendMu.Unlock()
+	}
+}
+
+// sendChunks sends data in hunks of at most maxHunkSize, the first one
+// carrying ack.
+func sendChunks(stream hunkStream, data []byte, ack uint64) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxHunkSize {
+			n = maxHunkSize
+		}
+		if err := stream.Send(&proto.Hunk{Data: data[:n], Ack: ack}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// resumableTun is the client end of a resumable Tun stream. When the stream
+// breaks, it is opened again on the same remote and the data the server
+// missed is sent again, until ResumeTimeout passes.
+type resumableTun struct {
+	resumeBuffer
+	g      *GunServiceClientImpl
+	ctx    context.Context
+	remote *remote
+	id     string
+
+	// sendMu orders sends, the data sent again on a new stream goes first
+	sendMu sync.Mutex
+	// stream is nil while resuming, guarded by mu like the fields below
+	stream proto.GunService_TunClient
+	cancel context.CancelFunc
+	closed bool
+}
+
+// openResumable opens a resumable Tun stream, forwarded to target by the
+// server if not empty.
+func (g *GunServiceClientImpl) openResumable(ctx context.Context, target string, opts ...grpc.CallOption) (tunStream, error) {
+	id, err := randomId()
+	if err != nil {
+		return nil, err
+	}
+	ctx = g.withShaping(ctx)
+	t := &resumableTun{g: g, ctx: ctx, id: id}
+	t.init()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	mdCtx := metadata.AppendToOutgoingContext(withTarget(streamCtx, target), sessionMetadataKey, id)
+	stream, r, err := g.openStreamOn(func(clientX proto.GunServiceClientX, serviceName string) (grpc.ClientStream, error) {
+		return clientX.TunCustomName(mdCtx, serviceName, opts...)
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if _, err := g.resumeHandshake(stream.(proto.GunService_TunClient)); err != nil {
+		cancel()
+		return nil, err
+	}
+	t.remote = r
+	t.stream = g.shape(stream.(proto.GunService_TunClient), false)
+	t.cancel = cancel
+	go t.ackLoop(&t.sendMu, func() hunkStream {
+		if t.stream == nil {
+			return nil
+		}
+		return t.stream
+	})
+	return t, nil
+}
+
+// resumeHandshake waits for the server to accept a resumable stream, and
+// returns the number of bytes it received in the session.
+func (g *GunServiceClientImpl) resumeHandshake(stream proto.GunService_TunClient) (uint64, error) {
+	md, err := waitHeader(stream, durationOr(g.ConnectTimeout, 5*time.Second))
+	if err != nil {
+		return 0, err
+	}
+	v := md.Get(resumeMetadataKey)
+	if len(v) == 0 {
+		// errors come without headers
+		if _, err := stream.Recv(); err != nil {
+			return 0, err
+		}
+		return 0, status.Error(codes.Unimplemented, "server does not support resumable streams")
+	}
+	return strconv.ParseUint(v[0], 10, 64)
+}
+
+func (t *resumableTun) send(data [][]byte) error {
+	for i := 0; i < len(data); {
+		t.mu.Lock()
+		err := t.waitRoom()
+		for t.stream == nil && err == nil {
+			t.changed.Wait()
+			err = t.err
+		}
+		t.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		t.sendMu.Lock()
+		t.mu.Lock()
+		stream := t.stream
+		if stream == nil {
+			// a resume began after the wait above, wait again
+			t.mu.Unlock()
+			t.sendMu.Unlock()
+			continue
+		}
+		ack := t.push(data[i])
+		t.mu.Unlock()
+		err = stream.Send(&proto.Hunk{Data: data[i], Ack: ack})
+		t.sendMu.Unlock()
+		if err != nil {
+			// the data is buffered, and sent again once resumed
+			if err := t.reattach(stream, err); err != nil {
+				return err
+			}
+		}
+		i++
+	}
+	return nil
+}
+
+func (t *resumableTun) recv() ([][]byte, error) {
+	for {
+		t.mu.Lock()
+		for t.stream == nil && t.err == nil {
+			t.changed.Wait()
+		}
+		stream, err := t.stream, t.err
+		t.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		hunk, err := stream.Recv()
+		if err == io.EOF {
+			t.mu.Lock()
+			current := t.stream == stream
+			t.mu.Unlock()
+			if !current {
+				// a stale stream, its handler was kicked out
+				continue
+			}
+			// the server only finishes once everything was sent
+			t.end(io.EOF)
+			return nil, io.EOF
+		} else if err != nil {
+			if err := t.reattach(stream, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		t.mu.Lock()
+		if t.stream != stream {
+			// received after the server was told where to resume, so it is
+			// sent again
+			t.mu.Unlock()
+			continue
+		}
+		t.ack(hunk.Ack)
+		t.receive(len(hunk.Data))
+		if hunk.Fin {
+			// upstream finished, the server ends the session once it knows
+			// everything arrived
+			t.ackNow()
+		}
+		t.mu.Unlock()
+		if len(hunk.Data) > 0 {
+			return [][]byte{hunk.Data}, nil
+		}
+	}
+}
+
+func (t *resumableTun) multi() bool {
+	return false
+}
+
+func (t *resumableTun) Context() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stream == nil {
+		return t.ctx
+	}
+	return t.stream.Context()
+}
+
+// closeSend tells the server the client is done sending, on the stream and
+// every stream resuming it. The stream itself is not half-closed, acks are
+// still sent on it.
+func (t *resumableTun) closeSend() error {
+	t.sendMu.Lock()
+	t.mu.Lock()
+	t.closed = true
+	stream, err := t.stream, t.err
+	ack := t.received
+	t.acked = ack
+	t.mu.Unlock()
+	if stream == nil {
+		t.sendMu.Unlock()
+		return err
+	}
+	err = stream.Send(&proto.Hunk{Ack: ack, Fin: true})
+	t.sendMu.Unlock()
+	if err != nil {
+		// sent again once resumed
+		return t.reattach(stream, err)
+	}
+	return nil
+}
+
+// end ends the session with err.
+func (t *resumableTun) end(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fail(err)
+	t.cancel()
+}
+
+// reattach resumes the session after failed broke with cause, unless it was
+// already.
+func (t *resumableTun) reattach(failed proto.GunService_TunClient, cause error) error {
+	t.mu.Lock()
+	if t.stream != failed || t.err != nil {
+		// resuming elsewhere, or resumed already
+		for t.stream == nil && t.err == nil {
+			t.changed.Wait()
+		}
+		err := t.err
+		t.mu.Unlock()
+		return err
+	}
+	// nothing received from now on counts, the server sends it again.
+	// Cancelling unblocks sends on the broken stream.
+	t.stream = nil
+	t.cancel()
+	t.mu.Unlock()
+
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+
+	log.Printf("stream of session %v broken, resuming: %v", t.id, cause)
+	deadline := time.Now().Add(durationOr(t.g.ResumeTimeout, 30*time.Second))
+	delay := 500 * time.Millisecond
+	for {
+		if t.ctx.Err() != nil {
+			// closed by the caller
+			t.end(t.ctx.Err())
+			return t.ctx.Err()
+		}
+		err := t.resume()
+		if err == nil {
+			log.Printf("session %v resumed", t.id)
+			return nil
+		}
+		code := status.Code(err)
+		if code != codes.Unavailable && code != codes.DeadlineExceeded || time.Now().Add(delay).After(deadline) {
+			log.Printf("failed to resume session %v: %v", t.id, err)
+			t.end(err)
+			return err
+		}
+		select {
+		case <-t.ctx.Done():
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > 5*time.Second {
+			delay = 5 * time.Second
+		}
+	}
+}
+
+// resume opens a stream resuming the session, and sends again the data the
+// server missed. It must be called with sendMu held.
+func (t *resumableTun) resume() error {
+	t.mu.Lock()
+	received := t.received
+	t.mu.Unlock()
+
+	streamCtx, cancel := context.WithCancel(t.ctx)
+	mdCtx := metadata.AppendToOutgoingContext(streamCtx,
+		sessionMetadataKey, t.id, resumeMetadataKey, strconv.FormatUint(received, 10))
+	s, err := t.remote.pool.openStream(func(clientX proto.GunServiceClientX) (grpc.ClientStream, error) {
+		return clientX.TunCustomName(mdCtx, t.remote.ServiceName)
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	stream := s.(proto.GunService_TunClient)
+	peerReceived, err := t.g.resumeHandshake(stream)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	t.mu.Lock()
+	data, err := t.rewind(peerReceived)
+	if err != nil {
+		t.mu.Unlock()
+		cancel()
+		return status.Error(codes.DataLoss, err.Error())
+	}
+	t.stream, t.cancel = t.g.shape(stream, false), cancel
+	t.acked = t.received
+	closed := t.closed
+	t.changed.Broadcast()
+	t.mu.Unlock()
+
+	// failures are noticed by the next send or receive
+	if sendChunks(stream, data, received) == nil && closed {
+		stream.Send(&proto.Hunk{Ack: received, Fin: true})
+	}
+	return nil
+}
+
+// serverSession is the server end of a resumable Tun stream, keeping the
+// upstream connection and the data not acknowledged while the client is
+// away.
+type serverSession struct {
+	resumeBuffer
+	id    string
+	owner string
+	conn  net.Conn
+	// finished is closed once upstream reached EOF and all of its data was
+	// buffered, drained once the client acknowledged all of it after that
+	finished chan struct{}
+	drained  chan struct{}
+
+	// sendMu orders sends, writeMu writes upstream and the count of data
+	// received
+	sendMu  sync.Mutex
+	writeMu sync.Mutex
+	// stream is nil while the client is away, guarded by mu like the
+	// fields below
+	stream proto.GunService_TunServer
+	// kicked is closed when stream is replaced
+	kicked   chan struct{}
+	upClosed bool
+	expiry   *time.Timer
+}
+
+// sessionFromContext returns the session id of a resumable stream.
+func sessionFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(sessionMetadataKey); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// resumableTun starts the session id of a resumable stream, or resumes it.
+func (g *GunServiceServerImpl) resumableTun(id string, server proto.GunService_TunServer) error {
+	ctx := server.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	resume := md.Get(resumeMetadataKey)
+	if len(resume) == 0 {
+		conn, err := g.dialUpstream(ctx)
+		if err != nil {
+			return err
+		}
+		s := &serverSession{id: id, owner: identity(ctx), conn: conn, finished: make(chan struct{}), drained: make(chan struct{})}
+		s.init()
+		g.sessionsMu.Lock()
+		if _, ok := g.sessions[id]; ok {
+			g.sessionsMu.Unlock()
+			conn.Close()
+			return status.Error(codes.AlreadyExists, "session exists")
+		}
+		g.sessions[id] = s
+		g.sessionsMu.Unlock()
+		go g.readUpstream(s)
+		go s.ackLoop(&s.sendMu, func() hunkStream {
+			if s.stream == nil {
+				return nil
+			}
+			return s.stream
+		})
+		return g.serveSession(s, server, 0)
+	}
+
+	peerReceived, err := strconv.ParseUint(resume[0], 10, 64)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid resume offset")
+	}
+	g.sessionsMu.Lock()
+	s := g.sessions[id]
+	g.sessionsMu.Unlock()
+	if s == nil || s.owner != identity(ctx) {
+		return status.Error(codes.NotFound, "unknown session")
+	}
+	log.Printf("resuming session %v for %v", id, describePeer(ctx))
+	return g.serveSession(s, server, peerReceived)
+}
+
+// serveSession attaches server to s, replacing the stream it had, and
+// relays until either the stream breaks or the session is finished.
+func (g *GunServiceServerImpl) serveSession(s *serverSession, server proto.GunService_TunServer, peerReceived uint64) error {
+	// a stream the server has not noticed as broken may block sends, it
+	// must go first
+	s.mu.Lock()
+	s.kick()
+	s.mu.Unlock()
+
+	s.sendMu.Lock()
+	s.writeMu.Lock()
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		s.writeMu.Unlock()
+		s.sendMu.Unlock()
+		return status.Error(codes.NotFound, "session closed")
+	}
+	data, err := s.rewind(peerReceived)
+	if err != nil {
+		s.mu.Unlock()
+		s.writeMu.Unlock()
+		s.sendMu.Unlock()
+		return status.Error(codes.DataLoss, err.Error())
+	}
+	s.kick()
+	kicked := make(chan struct{})
+	s.stream, s.kicked = server, kicked
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	received := s.received
+	s.acked = received
+	s.mu.Unlock()
+	s.writeMu.Unlock()
+
+	// receive while sending again, the client may be sending again too
+	recvErr := make(chan error, 1)
+	go func() {
+		recvErr <- g.recvSession(s, server)
+	}()
+	err = server.SendHeader(metadata.Pairs(resumeMetadataKey, strconv.FormatUint(received, 10)))
+	if err == nil {
+		err = sendChunks(server, data, received)
+	}
+	s.sendMu.Unlock()
+	if err != nil {
+		if !g.detachSession(s, server) {
+			return s.kickedErr()
+		}
+		return err
+	}
+
+	select {
+	case err = <-recvErr:
+		if err == nil {
+			// the client finished sending, keep the down link running
+			select {
+			case <-s.finished:
+				// the rest of the data reaches the client before the end of
+				// the stream
+				g.closeSession(s, io.EOF)
+				return nil
+			case <-kicked:
+				return s.kickedErr()
+			case <-server.Context().Done():
+				err = server.Context().Err()
+			}
+		}
+	case <-s.finished:
+		// the session is kept until the client acknowledges the rest of the
+		// data, which the fin asks for
+		if err = g.sendFin(s, server); err == nil {
+			select {
+			case <-s.drained:
+			case err = <-recvErr:
+			case <-kicked:
+				return s.kickedErr()
+			}
+		}
+		if err == nil {
+			g.closeSession(s, io.EOF)
+			return nil
+		}
+	case <-kicked:
+		return s.kickedErr()
+	}
+	// the client may come back for what it missed
+	if !g.detachSession(s, server) {
+		return s.kickedErr()
+	}
+	return err
+}
+
+// sendFin tells the client upstream finished once all of its data was sent.
+func (g *GunServiceServerImpl) sendFin(s *serverSession, server proto.GunService_TunServer) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.mu.Lock()
+	ack := s.received
+	s.acked = ack
+	s.mu.Unlock()
+	return server.Send(&proto.Hunk{Ack: ack, Fin: true})
+}
+
+// kick ends the handler of the current stream. It must be called with mu
+// held.
+func (s *serverSession) kick() {
+	if s.kicked != nil {
+		close(s.kicked)
+		s.kicked = nil
+	}
+	s.stream = nil
+}
+
+// kickedErr returns the error ending the stream of a handler kicked out of
+// s, either by a stream resuming it or because it was closed.
+func (s *serverSession) kickedErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return status.Error(codes.Unavailable, s.err.Error())
+	}
+	return status.Error(codes.Aborted, "session resumed by another stream")
+}
+
+// recvSession writes what the client sends upstream, closing it for writing
+// once the client is done sending. It returns nil when the client
+// half-closes the stream.
+func (g *GunServiceServerImpl) recvSession(s *serverSession, server proto.GunService_TunServer) error {
+	for {
+		hunk, err := server.Recv()
+		if err == io.EOF {
+			g.finishUpstream(s, server)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		s.writeMu.Lock()
+		s.mu.Lock()
+		current := s.stream == server
+		if current {
+			s.ack(hunk.Ack)
+			if len(s.unacked) == 0 && isClosedChan(s.finished) && !isClosedChan(s.drained) {
+				close(s.drained)
+			}
+		}
+		s.mu.Unlock()
+		if !current {
+			s.writeMu.Unlock()
+			return status.Error(codes.Aborted, "session resumed by another stream")
+		}
+		// acks and fins carry no data, and writing nothing fails once
+		// upstream is closed for writing
+		if len(hunk.Data) > 0 {
+			if _, err := s.conn.Write(hunk.Data); err != nil {
+				s.writeMu.Unlock()
+				g.closeSession(s, err)
+				return err
+			}
+			s.mu.Lock()
+			s.receive(len(hunk.Data))
+			s.mu.Unlock()
+		}
+		s.writeMu.Unlock()
+		if hunk.Fin {
+			g.finishUpstream(s, server)
+		}
+	}
+}
+
+// finishUpstream closes upstream for writing once, if server is still the
+// stream of s.
+func (g *GunServiceServerImpl) finishUpstream(s *serverSession, server proto.GunService_TunServer) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	closeUp := s.stream == server && !s.upClosed
+	s.upClosed = s.upClosed || closeUp
+	s.mu.Unlock()
+	if closeUp {
+		closeWrite(s.conn)
+	}
+}
+
+// readUpstream buffers what upstream sends, and sends it to the client
+// while it is there.
+func (g *GunServiceServerImpl) readUpstream(s *serverSession) {
+	buf := make([]byte, maxHunkSize)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			s.mu.Lock()
+			roomErr := s.waitRoom()
+			s.mu.Unlock()
+			if roomErr != nil {
+				return
+			}
+
+			s.sendMu.Lock()
+			s.mu.Lock()
+			ack := s.push(buf[:n])
+			stream := s.stream
+			s.mu.Unlock()
+			if stream != nil {
+				// failures are noticed by the handler of the stream
+				stream.Send(&proto.Hunk{Data: buf[:n], Ack: ack})
+			}
+			s.sendMu.Unlock()
+		}
+		if err == io.EOF {
+			s.sendMu.Lock()
+			close(s.finished)
+			s.sendMu.Unlock()
+			return
+		} else if err != nil {
+			g.closeSession(s, err)
+			return
+		}
+	}
+}
+
+// detachSession keeps s for ResumeTimeout after server broke. It reports
+// false if server was replaced or s closed already.
+func (g *GunServiceServerImpl) detachSession(s *serverSession, server proto.GunService_TunServer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream != server || s.err != nil {
+		return false
+	}
+	s.kick()
+	s.expiry = time.AfterFunc(durationOr(g.ResumeTimeout, 30*time.Second), func() {
+		g.closeSession(s, errSessionExpired)
+	})
+	return true
+}
+
+// closeSession drops s and closes its upstream connection.
+func (g *GunServiceServerImpl) closeSession(s *serverSession, err error) {
+	g.sessionsMu.Lock()
+	if g.sessions[s.id] == s {
+		delete(g.sessions, s.id)
+	}
+	g.sessionsMu.Unlock()
+
+	s.mu.Lock()
+	closed := s.err != nil
+	s.fail(err)
+	s.kick()
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.mu.Unlock()
+	if !closed {
+		if err != io.EOF && (err != errSessionExpired || !isClosedChan(s.finished)) {
+			log.Printf("session %v closed: %v", s.id, err)
+		}
+		s.conn.Close()
+	}
+}
+
+// closeSessions drops every session, when the server stops.
+func (g *GunServiceServerImpl) closeSessions() {
+	g.sessionsMu.Lock()
+	sessions := make([]*serverSession, 0, len(g.sessions))
+	for _, s := range g.sessions {
+		sessions = append(sessions, s)
+	}
+	g.sessionsMu.Unlock()
+	for _, s := range sessions {
+		g.closeSession(s, net.ErrClosed)
+	}
+}
@@ -0,0 +1,303 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// cutProxy relays TCP connections to target, until cut breaks them.
+type cutProxy struct {
+	target string
+	mu     sync.Mutex
+	conns  []net.Conn
+}
+
+// startCutProxy starts a cutProxy to target, and returns its address.
+func startCutProxy(t *testing.T, target string) (*cutProxy, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &cutProxy{target: target}
+	t.Cleanup(func() {
+		listener.Close()
+		p.cut()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.mu.Unlock()
+			go io.Copy(conn, upstream)
+			go io.Copy(upstream, conn)
+		}
+	}()
+	return p, listener.Addr().String()
+}
+
+// cut closes every connection relayed so far.
+func (p *cutProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+// startResumeServer starts a server forwarding to upstream.
+func startResumeServer(t *testing.T, upstream string, users map[string]string, timeout time.Duration) *GunServiceServerImpl {
+	t.Helper()
+	server := &GunServiceServerImpl{
+		LocalAddr:     "127.0.0.1:0",
+		RemoteAddr:    upstream,
+		Cleartext:     true,
+		ServiceName:   "S",
+		Users:         users,
+		ResumeTimeout: timeout,
+	}
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return server
+}
+
+func sessionCount(g *GunServiceServerImpl) int {
+	g.sessionsMu.Lock()
+	defer g.sessionsMu.Unlock()
+	return len(g.sessions)
+}
+
+// openSession opens a stream of the session id on conn, resuming it at
+// resume if not empty, and returns the error the server answers with.
+func openSession(ctx context.Context, conn *grpc.ClientConn, id, resume string, opts ...grpc.CallOption) (proto.GunService_TunClient, error) {
+	md := []string{sessionMetadataKey, id}
+	if resume != "" {
+		md = append(md, resumeMetadataKey, resume)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, md...)
+	stream, err := proto.NewGunServiceClient(conn).(proto.GunServiceClientX).TunCustomName(ctx, "S", opts...)
+	if err != nil {
+		return nil, err
+	}
+	_, err = (&GunServiceClientImpl{}).resumeHandshake(stream)
+	return stream, err
+}
+
+func TestResumeBufferRewind(t *testing.T) {
+	tests := []struct {
+		name   string
+		acked  uint64
+		resume uint64
+		want   string
+		ok     bool
+	}{
+		{"nothing received", 0, 0, "abcdef", true},
+		{"partly received", 0, 4, "ef", true},
+		{"all received", 2, 6, "", true},
+		{"acked before", 2, 2, "cdef", true},
+		{"behind the ack", 2, 1, "", false},
+		{"beyond the data", 0, 7, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b resumeBuffer
+			b.init()
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.push([]byte("abcdef"))
+			b.ack(tt.acked)
+			data, err := b.rewind(tt.resume)
+			if (err == nil) != tt.ok {
+				t.Fatalf("rewind(%v): %v", tt.resume, err)
+			}
+			if tt.ok && string(data) != tt.want {
+				t.Fatalf("rewind(%v) = %q, want %q", tt.resume, data, tt.want)
+			}
+		})
+	}
+}
+
+func TestResumeReattach(t *testing.T) {
+	server := startResumeServer(t, tcpEcho(t).String(), nil, 0)
+	proxy, addr := startCutProxy(t, server.listener.Addr().String())
+	g := &GunServiceClientImpl{Resume: true}
+	startClient(t, g, addr)
+	local := g.local.Addr()
+
+	conn, err := net.Dial("tcp", local.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !exchange(conn, "hello") {
+		t.Fatal("no echo")
+	}
+
+	proxy.cut()
+	if _, err := conn.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "again" {
+		t.Fatalf("after the stream broke: %q, %v", buf, err)
+	}
+	if n := sessionCount(server); n != 1 {
+		t.Fatalf("%d sessions, want the one resumed", n)
+	}
+}
+
+func TestResumeReplaysUnacked(t *testing.T) {
+	server := startResumeServer(t, tcpEcho(t).String(), nil, 0)
+	proxy, addr := startCutProxy(t, server.listener.Addr().String())
+	g := &GunServiceClientImpl{Resume: true}
+	startClient(t, g, addr)
+	local := g.local.Addr()
+
+	conn, err := net.Dial("tcp", local.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+
+	// more than is acknowledged at once, so some is in flight either way
+	// when the stream breaks
+	sent := make([]byte, 512<<10)
+	rand.New(rand.NewSource(1)).Read(sent)
+	go conn.Write(sent)
+
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(conn, received[:64<<10]); err != nil {
+		t.Fatal(err)
+	}
+	proxy.cut()
+	if _, err := io.ReadFull(conn, received[64<<10:]); err != nil {
+		t.Fatalf("after the stream broke: %v", err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Fatal("data received differs from the data sent")
+	}
+}
+
+func TestResumeExpiry(t *testing.T) {
+	server := startResumeServer(t, tcpEcho(t).String(), nil, 100*time.Millisecond)
+
+	conn, err := grpc.Dial(server.listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamCtx, drop := context.WithCancel(ctx)
+	if _, err := openSession(streamCtx, conn, "expiring", ""); err != nil {
+		t.Fatal(err)
+	}
+	drop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sessionCount(server) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session kept after the resume timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := openSession(ctx, conn, "expiring", "0"); status.Code(err) != codes.NotFound {
+		t.Fatalf("resuming an expired session: %v", err)
+	}
+}
+
+func TestResumeRejectsOtherIdentity(t *testing.T) {
+	users := map[string]string{"alice": "token1", "bob": "token2"}
+	server := startResumeServer(t, tcpEcho(t).String(), users, time.Minute)
+
+	conn, err := grpc.Dial(server.listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	alice := grpc.PerRPCCredentials(NewTokenCredentials("alice", "token1"))
+	bob := grpc.PerRPCCredentials(NewTokenCredentials("bob", "token2"))
+
+	streamCtx, drop := context.WithCancel(ctx)
+	if _, err := openSession(streamCtx, conn, "alice's", "", alice); err != nil {
+		t.Fatal(err)
+	}
+	drop()
+
+	if _, err := openSession(ctx, conn, "alice's", "0", bob); status.Code(err) != codes.NotFound {
+		t.Fatalf("resuming the session of another user: %v", err)
+	}
+	if _, err := openSession(ctx, conn, "alice's", "0", alice); err != nil {
+		t.Fatalf("resuming the session of the same user: %v", err)
+	}
+}
+
+func TestResumeClosesFinishedSession(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "bye")
+			conn.Close()
+		}
+	}()
+	server := startResumeServer(t, upstream.Addr().String(), nil, time.Minute)
+	g := &GunServiceClientImpl{Resume: true}
+	startClient(t, g, server.listener.Addr().String())
+	local := g.local.Addr()
+
+	conn, err := net.Dial("tcp", local.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "bye" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+
+	// the client received everything, nothing is kept for it to resume
+	deadline := time.Now().Add(2 * time.Second)
+	for sessionCount(server) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("finished session kept after the client received everything")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,303 @@
+package impl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// reverseIdMetadataKey carries the id of the connection a Reverse stream
+// carries. Control streams have none.
+const reverseIdMetadataKey = "gun-reverse-id"
+
+const (
+	// reversePickupTimeout is how long an accepted connection waits for the
+	// client to open its stream
+	reversePickupTimeout = 10 * time.Second
+	// reverseKeepalive is how often the client sends an empty hunk on the
+	// control stream, keeping NAT mappings of idle tunnels alive
+	reverseKeepalive = 30 * time.Second
+)
+
+// reverseTunnel is the state of the reverse tunnel held by a client.
+type reverseTunnel struct {
+	mu       sync.Mutex
+	listener net.Listener
+	// owner is the identity of the client holding the tunnel
+	owner string
+	// pending connections wait for the client to open their stream
+	pending map[string]net.Conn
+	closed  bool
+}
+
+// Reverse serves either the control stream of a reverse tunnel or the
+// stream of one of its connections.
+func (g *GunServiceServerImpl) Reverse(server proto.GunService_ReverseServer) error {
+	if g.ReverseAddr == "" {
+		return status.Error(codes.FailedPrecondition, "reverse tunnels are not enabled")
+	}
+	ctx := server.Context()
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(reverseIdMetadataKey); len(v) > 0 {
+			return g.reverseStream(v[0], hunkTun{server})
+		}
+	}
+	return g.reverseControl(server)
+}
+
+// reverseControl listens on ReverseAddr while the client holds the control
+// stream, telling it the id of each accepted connection.
+func (g *GunServiceServerImpl) reverseControl(server proto.GunService_ReverseServer) error {
+	r := &g.reverse
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return status.Error(codes.Unavailable, "server shutting down")
+	}
+	if r.listener != nil {
+		r.mu.Unlock()
+		return status.Error(codes.AlreadyExists, "another client holds the reverse tunnel")
+	}
+	listener, err := net.Listen("tcp", g.ReverseAddr)
+	if err != nil {
+		r.mu.Unlock()
+		return status.Errorf(codes.Unavailable, "failed to listen: %v", err)
+	}
+	r.listener = listener
+	r.owner = identity(server.Context())
+	r.pending = make(map[string]net.Conn)
+	r.mu.Unlock()
+	log.Printf("reverse tunnel for %v listening on %v", describePeer(server.Context()), g.ReverseAddr)
+	// an empty hunk tells the client it holds the tunnel
+	if err := server.Send(&proto.Hunk{}); err != nil {
+		listener.Close()
+	}
+
+	// the client only sends keepalives, the stream ends with it
+	go func() {
+		for {
+			if _, err := server.Recv(); err != nil {
+				listener.Close()
+				return
+			}
+		}
+	}()
+
+	err = g.acceptReverse(listener, server)
+	r.mu.Lock()
+	r.listener = nil
+	for id, conn := range r.pending {
+		conn.Close()
+		delete(r.pending, id)
+	}
+	r.mu.Unlock()
+	log.Printf("reverse tunnel for %v closed", describePeer(server.Context()))
+	return err
+}
+
+func (g *GunServiceServerImpl) acceptReverse(listener net.Listener, server proto.GunService_ReverseServer) error {
+	r := &g.reverse
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				r.mu.Lock()
+				closed := r.closed
+				r.mu.Unlock()
+				if closed {
+					return status.Error(codes.Unavailable, "server shutting down")
+				}
+				return nil
+			}
+			return err
+		}
+		id, err := randomId()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		r.mu.Lock()
+		r.pending[id] = conn
+		r.mu.Unlock()
+		time.AfterFunc(reversePickupTimeout, func() {
+			if conn := r.take(id); conn != nil {
+				log.Printf("reverse connection from %v not picked up", conn.RemoteAddr())
+				conn.Close()
+			}
+		})
+		if err := server.Send(&proto.Hunk{Data: []byte(id)}); err != nil {
+			return err
+		}
+	}
+}
+
+// reverseStream relays the connection of id over a stream opened by the
+// client holding the tunnel.
+func (g *GunServiceServerImpl) reverseStream(id string, server tunStream) error {
+	conn, err := g.reverse.pickUp(id, identity(server.Context()))
+	if err != nil {
+		return err
+	}
+	up, down := g.rateLimits(server.Context())
+	conn = limitConn(conn, down, up)
+	defer conn.Close()
+	log.Printf("new reverse stream: %v <-> %v", conn.RemoteAddr(), describePeer(server.Context()))
+	return relay(conn, server)
+}
+
+// pickUp removes the pending connection of id for a stream of the client
+// identified as owner. Streams of other clients are refused, leaving the
+// connection to the one holding the tunnel.
+func (r *reverseTunnel) pickUp(id, owner string) (net.Conn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.listener != nil && owner != r.owner {
+		return nil, status.Error(codes.PermissionDenied, "reverse tunnel held by another client")
+	}
+	conn := r.pending[id]
+	if conn == nil {
+		return nil, status.Error(codes.NotFound, "unknown reverse connection")
+	}
+	delete(r.pending, id)
+	return conn, nil
+}
+
+// take removes the pending connection of id.
+func (r *reverseTunnel) take(id string) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conn := r.pending[id]
+	delete(r.pending, id)
+	return conn
+}
+
+// close stops listening for good, ending the control stream. Connections
+// already relayed are not affected.
+func (r *reverseTunnel) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.listener != nil {
+		r.listener.Close()
+	}
+}
+
+// randomId returns 64 random bits in hex.
+func randomId() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// reverseLoop holds a reverse tunnel until the client stops, connecting
+// again whenever it is lost.
+func (g *GunServiceClientImpl) reverseLoop(ctx context.Context) {
+	const maxDelay = 30 * time.Second
+	delay := time.Second
+	for {
+		held, err := g.holdReverse(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if held {
+			delay = time.Second
+		}
+		log.Printf("reverse tunnel lost: %v, retrying in %v", err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// holdReverse opens the control stream on a remote and forwards the
+// connections it announces to ReverseTarget, until the stream ends. held
+// reports whether the stream was established.
+func (g *GunServiceClientImpl) holdReverse(ctx context.Context) (held bool, err error) {
+	r := g.pickRemote()
+	stream, err := r.pool.openStream(func(clientX proto.GunServiceClientX) (grpc.ClientStream, error) {
+		return clientX.ReverseCustomName(ctx, r.ServiceName)
+	})
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			r.setHealth(false, 0, err)
+		}
+		return false, err
+	}
+	control := stream.(proto.GunService_ReverseClient)
+	// the server answers once listening, or with an error
+	announce, err := control.Recv()
+	if err != nil {
+		return false, err
+	}
+	log.Printf("reverse tunnel held on %v, forwarding to %v", r.Addr, g.ReverseTarget)
+
+	keepaliveDone := make(chan struct{})
+	defer close(keepaliveDone)
+	go func() {
+		tick := time.NewTicker(reverseKeepalive)
+		defer tick.Stop()
+		for {
+			select {
+			case <-keepaliveDone:
+				return
+			case <-tick.C:
+				if control.Send(&proto.Hunk{}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		if id := string(announce.Data); id != "" {
+			g.handlers.Add(1)
+			go func() {
+				defer g.handlers.Done()
+				g.serveReverse(r, id)
+			}()
+		}
+		if announce, err = control.Recv(); err != nil {
+			return true, err
+		}
+	}
+}
+
+// serveReverse forwards the connection of id to ReverseTarget. The stream
+// must be opened on the remote holding the tunnel.
+func (g *GunServiceClientImpl) serveReverse(r *remote, id string) {
+	local, err := net.Dial("tcp", g.ReverseTarget)
+	if err != nil {
+		log.Printf("failed to dial reverse target: %v", err)
+		return
+	}
+	defer local.Close()
+	ctx := metadata.AppendToOutgoingContext(g.ctx, reverseIdMetadataKey, id)
+	stream, err := r.pool.openStream(func(clientX proto.GunServiceClientX) (grpc.ClientStream, error) {
+		return clientX.ReverseCustomName(ctx, r.ServiceName)
+	})
+	if err != nil {
+		log.Printf("failed to create context: %v", err)
+		return
+	}
+	log.Printf("reverse connection: %v <-> %v", r.Addr, local.RemoteAddr())
+	g.pipe(local, hunkTun{stream.(proto.GunService_ReverseClient)})
+}
@@ -0,0 +1,109 @@
+package impl
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestReverseRequiresAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		users   map[string]string
+		wantErr bool
+	}{
+		{"anonymous", nil, true},
+		{"users", map[string]string{"alice": "secret"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &GunServiceServerImpl{
+				LocalAddr:   "127.0.0.1:0",
+				Cleartext:   true,
+				ServiceName: "S",
+				ReverseAddr: "127.0.0.1:0",
+				Users:       tt.users,
+			}
+			err := server.Start(context.Background())
+			if err == nil {
+				server.Shutdown(context.Background())
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("start: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReverseStreamOwner(t *testing.T) {
+	server := &GunServiceServerImpl{
+		LocalAddr:   "127.0.0.1:0",
+		Cleartext:   true,
+		ServiceName: "S",
+		ReverseAddr: "127.0.0.1:0",
+		Users:       map[string]string{"alice": "token1", "bob": "token2"},
+	}
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	conn, err := grpc.Dial(server.listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := proto.NewGunServiceClient(conn).(proto.GunServiceClientX)
+	alice := grpc.PerRPCCredentials(NewTokenCredentials("alice", "token1"))
+	bob := grpc.PerRPCCredentials(NewTokenCredentials("bob", "token2"))
+
+	control, err := client.ReverseCustomName(ctx, "S", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := control.Recv(); err != nil {
+		t.Fatalf("holding the tunnel: %v", err)
+	}
+	server.reverse.mu.Lock()
+	addr := server.reverse.listener.Addr().String()
+	server.reverse.mu.Unlock()
+	visitor, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	announce, err := control.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamCtx := metadata.AppendToOutgoingContext(ctx, reverseIdMetadataKey, string(announce.Data))
+
+	stolen, err := client.ReverseCustomName(streamCtx, "S", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stolen.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("stream of another user: %v", err)
+	}
+
+	// the connection is left to the client holding the tunnel
+	stream, err := client.ReverseCustomName(streamCtx, "S", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := visitor.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if hunk, err := stream.Recv(); err != nil || string(hunk.Data) != "hello" {
+		t.Fatalf("received %v, %v", hunk, err)
+	}
+}
@@ -1,211 +1,611 @@
 package impl
 
 import (
+	"context"
 	"crypto/tls"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/Qv2ray/gun/pkg/cert"
 	"github.com/Qv2ray/gun/pkg/proto"
+	"github.com/Qv2ray/gun/pkg/proxyproto"
+	"github.com/Qv2ray/gun/pkg/ratelimit"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 type GunServiceServerImpl struct {
-	RemoteAddr  string
-	LocalAddr   string
-	CertPath    string
-	KeyPath     string
-	Cleartext   bool
-	UdpSessions *sync.Map
+	RemoteAddr string
+	LocalAddr  string
+	CertPath   string
+	KeyPath    string
+	Cleartext  bool
 
 	ServiceName string
+	// AllowedTargets lists the destinations clients may ask for instead of
+	// RemoteAddr, see parseTargetPolicy for the syntax
+	AllowedTargets []string
+	// Users maps user names to tokens, every stream must authenticate with
+	// one of them if not empty
+	Users map[string]string
+	// ClientCAPath is a PEM bundle of CAs, clients must present a
+	// certificate signed by one of them if set
+	ClientCAPath string
+	// FallbackDir or FallbackURL serve requests which are not gRPC, as a
+	// static directory or by proxying to a web server, so the server looks
+	// like a website to anyone else, HTTP/1.1 clients included
+	FallbackDir string
+	FallbackURL string
+	// CertReloadInterval is how often the certificate files are checked for
+	// changes, defaults to a minute
+	CertReloadInterval time.Duration
+	// UdpTimeout clears UDP sessions idle for this long, defaults to 2
+	// minutes
+	UdpTimeout time.Duration
+	// MaxUdpSessions bounds the UDP sessions open at once, the least
+	// recently active one is closed to open another beyond. Unlimited if
+	// not set.
+	MaxUdpSessions int
+	// UdpNat sets which datagrams received by the socket of a UDP session
+	// are passed to the client, NatPortRestricted by default
+	UdpNat string
+	// HealthCheckInterval is how often RemoteAddr is dialed to report the
+	// health of the server, defaults to 10 seconds
+	HealthCheckInterval time.Duration
+	// AcceptProxyProtocol requires a PROXY protocol v1 or v2 header on every
+	// connection, from a load balancer in front of the server
+	AcceptProxyProtocol bool
+	// SendProxyProtocol sends a PROXY protocol v2 header carrying the
+	// address of the original client upstream, before the data of Tun
+	// streams and every datagram of TunDatagram streams
+	SendProxyProtocol bool
+	// ReverseAddr is listened on while a client holds a reverse tunnel,
+	// connections accepted there are relayed to that client. It requires
+	// Users or ClientCAPath
+	ReverseAddr string
+	// ResumeTimeout is how long the session of a resumable stream is kept
+	// after the stream broke, defaults to 30 seconds
+	ResumeTimeout time.Duration
+	// RateLimit, UserRateLimit and StreamRateLimit bound the bandwidth of
+	// all streams together, of the streams of each authenticated user and
+	// of each stream
+	RateLimit       RateLimit
+	UserRateLimit   RateLimit
+	StreamRateLimit RateLimit
+
+	keyPair *cert.KeyPairReloader
+	reverse reverseTunnel
+	targets targetPolicy
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	server  *grpc.Server
+	health  *health.Server
+	// httpServer serves gRPC and the fallback if there is one
+	httpServer  *http.Server
+	listener    net.Listener
+	httpStreams sync.WaitGroup
+	drainMu     sync.Mutex
+	draining    bool
+	loops       sync.WaitGroup
+	serveErr    error
+	done        chan struct{}
+
+	// sessions of resumable streams by id
+	sessionsMu sync.Mutex
+	sessions   map[string]*serverSession
+
+	udpSessions *udpTable
+
+	rates       rateBuckets
+	userRatesMu sync.Mutex
+	userRates   map[string]rateBuckets
+}
+
+// Run starts the server and blocks until it is shut down.
+func (g *GunServiceServerImpl) Run() error {
+	if err := g.Start(context.Background()); err != nil {
+		return err
+	}
+	<-g.Done()
+	return g.Err()
 }
 
-func (g GunServiceServerImpl) Run() {
-	g.UdpSessions = new(sync.Map)
-	var s *grpc.Server
+// Start listens on LocalAddr and serves in background. Cancelling ctx stops
+// the server immediately, use Shutdown to drain.
+func (g *GunServiceServerImpl) Start(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done != nil {
+		return errors.New("server already started")
+	}
+	g.udpSessions = newUdpTable(sideServer, durationOr(g.UdpTimeout, 2*time.Minute), g.MaxUdpSessions)
+	g.sessions = make(map[string]*serverSession)
+	targets, err := parseTargetPolicy(g.AllowedTargets)
+	if err != nil {
+		return err
+	}
+	if err := validateRateLimits(g.RateLimit, g.UserRateLimit, g.StreamRateLimit); err != nil {
+		return err
+	}
+	switch g.UdpNat {
+	case "", NatPortRestricted, NatRestricted, NatFullCone:
+	default:
+		return fmt.Errorf("unknown udp nat %q", g.UdpNat)
+	}
+	if g.ReverseAddr != "" && len(g.Users) == 0 && g.ClientCAPath == "" {
+		// the first client asking would hold the reverse tunnel
+		return errors.New("reverse tunnels require users or client certificates")
+	}
+	g.rates = newRateBuckets(g.RateLimit)
+	g.userRates = make(map[string]rateBuckets)
+	g.targets = targets
+
+	interceptors := []grpc.StreamServerInterceptor{metricsServerInterceptor}
+	if len(g.Users) > 0 {
+		interceptors = append(interceptors, NewAuthInterceptor(g.Users))
+	}
+	serverOptions := []grpc.ServerOption{grpc.ChainStreamInterceptor(interceptors...)}
+	var config *tls.Config
 	if !g.Cleartext {
-		pub, err := ioutil.ReadFile(g.CertPath)
-		if err != nil {
-			log.Fatalf("failed to read certificate: %v", err)
-		}
-		key, err := ioutil.ReadFile(g.KeyPath)
+		config, err = g.serverTLSConfig()
 		if err != nil {
-			log.Fatalf("failed to read certificate key: %v", err)
+			return err
 		}
-		cert, e := tls.X509KeyPair(pub, key)
-		if e != nil {
-			log.Fatalf("failed to build certificate pair: %v", e)
+	} else if g.ClientCAPath != "" {
+		return errors.New("client certificates require TLS")
+	}
+	fallback := g.FallbackDir != "" || g.FallbackURL != ""
+	if config != nil && !fallback {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(config)))
+	}
+	s := grpc.NewServer(serverOptions...)
+	g.server = s
+	if fallback {
+		// gRPC is served through the HTTP server, which terminates TLS
+		if g.httpServer, err = g.newHttpServer(config); err != nil {
+			return err
 		}
-		log.Println("certificate pair built successfully")
-		s = grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
-	} else {
-		s = grpc.NewServer()
 	}
 
 	proto.RegisterGunServiceServerX(s, g, g.ServiceName)
+	g.health = health.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, g.health)
 
 	// listen local
 	listener, e := net.Listen("tcp", g.LocalAddr)
 	if e != nil {
-		log.Fatalf("failed to listen: %v", e)
+		return fmt.Errorf("failed to listen: %w", e)
+	}
+	if g.AcceptProxyProtocol {
+		listener = proxyproto.NewListener(listener)
 	}
 
 	log.Printf("starting listening on: %v", g.LocalAddr)
-	go g.scanInactiveSession(2 * time.Minute)
-	e = s.Serve(listener)
-	log.Fatalf("server abort: %v", e)
+	g.listener = listener
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	g.done = make(chan struct{})
+
+	g.loops.Add(3)
+	go func() {
+		defer g.loops.Done()
+		g.checkUpstream(durationOr(g.HealthCheckInterval, 10*time.Second))
+	}()
+	go func() {
+		defer g.loops.Done()
+		g.udpSessions.expire(g.ctx)
+	}()
+	if g.keyPair != nil {
+		g.loops.Add(1)
+		go func() {
+			defer g.loops.Done()
+			g.keyPair.Watch(g.ctx, durationOr(g.CertReloadInterval, time.Minute))
+		}()
+	}
+	go func() {
+		defer g.loops.Done()
+		serve := s.Serve
+		if g.httpServer != nil {
+			serve = g.serveHttp
+		}
+		if e := serve(listener); e != nil {
+			log.Printf("server abort: %v", e)
+			g.mu.Lock()
+			g.serveErr = e
+			g.mu.Unlock()
+		}
+		g.cancel()
+	}()
+	go func() {
+		<-g.ctx.Done()
+		if g.httpServer != nil {
+			g.httpServer.Close()
+		}
+		s.Stop()
+		g.closeSessions()
+		g.loops.Wait()
+		close(g.done)
+	}()
+	return nil
+}
+
+// ReloadCertificate reloads the certificate pair now instead of waiting for
+// the files to be noticed as changed. The current pair is kept on error.
+func (g *GunServiceServerImpl) ReloadCertificate() error {
+	g.mu.Lock()
+	keyPair := g.keyPair
+	g.mu.Unlock()
+	if keyPair == nil {
+		return errors.New("no certificate to reload")
+	}
+	return keyPair.Reload()
 }
 
-func (g GunServiceServerImpl) Tun(server proto.GunService_TunServer) error {
-	conn, err := net.Dial("tcp", g.RemoteAddr)
+// Shutdown stops accepting new streams and waits for active ones to finish.
+// Streams still active when ctx expires are closed forcibly.
+func (g *GunServiceServerImpl) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	started := g.done != nil
+	g.mu.Unlock()
+	if !started {
+		return errors.New("server not started")
+	}
+
+	// tell load balancers first, then stop accepting streams
+	g.health.Shutdown()
+	g.reverse.close()
+	stopped := make(chan struct{})
+	go func() {
+		if g.httpServer != nil {
+			// streams served over HTTP cannot be drained by gRPC itself
+			g.drainHttp()
+		} else {
+			g.server.GracefulStop()
+		}
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	g.cancel()
+	<-g.done
+	return err
+}
+
+// Done returns a channel which is closed when the server has stopped.
+func (g *GunServiceServerImpl) Done() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
+
+// Err returns the error which made the server stop serving, if any.
+func (g *GunServiceServerImpl) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.serveErr
+}
+
+// checkUpstream reports the server as serving while RemoteAddr can be
+// dialed, to the standard health service. Without RemoteAddr, the server is
+// always serving.
+func (g *GunServiceServerImpl) checkUpstream(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	serving := true
+	for {
+		if g.RemoteAddr != "" {
+			ctx, cancel := context.WithTimeout(g.ctx, interval)
+			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", g.RemoteAddr)
+			cancel()
+			if err == nil {
+				conn.Close()
+			}
+			if (err == nil) != serving {
+				serving = err == nil
+				if serving {
+					log.Printf("upstream %v is reachable again", g.RemoteAddr)
+				} else {
+					log.Printf("upstream %v is unreachable: %v", g.RemoteAddr, err)
+				}
+			}
+		}
+		status := grpc_health_v1.HealthCheckResponse_SERVING
+		if !serving {
+			status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+		// the empty service is the server as a whole
+		g.health.SetServingStatus("", status)
+		g.health.SetServingStatus(g.ServiceName, status)
+
+		select {
+		case <-g.ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (g *GunServiceServerImpl) Tun(server proto.GunService_TunServer) error {
+	server, stop, err := shapeServer(server, false)
 	if err != nil {
 		return err
 	}
+	defer stop()
+	if id := sessionFromContext(server.Context()); id != "" {
+		return g.resumableTun(id, server)
+	}
+	return g.tun(hunkTun{server})
+}
 
+func (g *GunServiceServerImpl) TunMulti(server proto.GunService_TunMultiServer) error {
+	return g.tun(multiHunkTun{server})
+}
+
+// upstream returns the address a stream is forwarded to, either the target
+// asked for by the client or RemoteAddr.
+func (g *GunServiceServerImpl) upstream(ctx context.Context) (string, error) {
+	target := targetFromContext(ctx)
+	if target == "" {
+		if g.RemoteAddr == "" {
+			return "", status.Error(codes.InvalidArgument, "no target given")
+		}
+		return g.RemoteAddr, nil
+	}
+	addr, err := g.targets.resolve(ctx, target)
+	if err != nil {
+		log.Printf("rejected target %v: %v", target, err)
+	}
+	return addr, err
+}
+
+// describePeer returns the address of the client of a stream, along with
+// its identity if authenticated.
+func describePeer(ctx context.Context) string {
+	remote := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+	}
+	if id := identity(ctx); id != "" {
+		return remote + " (" + id + ")"
+	}
+	return remote
+}
+
+func (g *GunServiceServerImpl) tun(server tunStream) error {
+	conn, err := g.dialUpstream(server.Context())
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
+	// proxies tell their clients the target is connected, see waitDialed
+	if err := grpc.SendHeader(server.Context(), metadata.Pairs(dialedMetadataKey, "1")); err != nil {
+		return err
+	}
+	return relay(conn, server)
+}
 
-	errChan := make(chan error)
+// dialUpstream connects to the upstream of a stream, and sends it the PROXY
+// protocol header if SendProxyProtocol is set.
+func (g *GunServiceServerImpl) dialUpstream(ctx context.Context) (net.Conn, error) {
+	addr, err := g.upstream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	conn, err := net.Dial("tcp", addr)
+	observeDial(sideServer, start, err)
+	if err != nil {
+		return nil, dialError(addr, err)
+	}
+	log.Printf("new stream: %v <-> %v", describePeer(ctx), addr)
 
-	go func() {
-		for {
-			if recv, err := server.Recv(); err != nil {
-				errChan <- err
-				return
-			} else if _, err = conn.Write(recv.Data); err != nil {
-				errChan <- err
-				return
-			}
+	if g.SendProxyProtocol {
+		header := proxyproto.AppendV2(nil, streamSource(ctx), conn.RemoteAddr())
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, err
 		}
-	}()
+	}
+	up, down := g.rateLimits(ctx)
+	return limitConn(conn, down, up), nil
+}
+
+// dialError is the status of a stream whose upstream could not be
+// connected: Unavailable if it refused the connection, NotFound if it could
+// not be reached.
+func dialError(addr string, err error) error {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return status.Errorf(codes.Unavailable, "upstream %v refused the connection", addr)
+	}
+	return status.Errorf(codes.NotFound, "failed to reach upstream %v: %v", addr, err)
+}
+
+// rateLimits returns the buckets bounding a new stream in each direction,
+// from the global ones to its own.
+func (g *GunServiceServerImpl) rateLimits(ctx context.Context) (up, down []*ratelimit.Bucket) {
+	up, down = []*ratelimit.Bucket{g.rates.up}, []*ratelimit.Bucket{g.rates.down}
+	if user := identity(ctx); user != "" && g.UserRateLimit != (RateLimit{}) {
+		g.userRatesMu.Lock()
+		buckets, ok := g.userRates[user]
+		if !ok {
+			buckets = newRateBuckets(g.UserRateLimit)
+			g.userRates[user] = buckets
+		}
+		g.userRatesMu.Unlock()
+		up, down = append(up, buckets.up), append(down, buckets.down)
+	}
+	stream := newRateBuckets(g.StreamRateLimit)
+	return append(up, stream.up), append(down, stream.down)
+}
+
+// relay copies between conn and a stream until either direction fails or
+// both are done.
+func relay(conn net.Conn, server tunStream) error {
+	errChan := make(chan error, 2)
 
 	go func() {
-		buf := make([]byte, 32768)
-		for {
-			if nRecv, err := conn.Read(buf); err != nil {
-				errChan <- err
-				return
-			} else if err = server.Send(&proto.Hunk{Data: buf[:nRecv]}); err != nil {
-				errChan <- err
-				return
-			}
+		// the client finished sending, pass the half close on and keep
+		// the down link running
+		if err := copyFromStream(conn, server); err != nil {
+			errChan <- err
+		} else if err = closeWrite(conn); err != nil {
+			errChan <- err
 		}
 	}()
 
-	err = <-errChan
-	return err
-}
+	go func() {
+		errChan <- copyToStream(server, conn)
+	}()
 
-type ServerUdpSession struct {
-	LastActive time.Time
-	Tun        proto.GunService_TunDatagramServer
-	Socket     net.PacketConn
+	return <-errChan
 }
 
-func (g GunServiceServerImpl) TunDatagram(server proto.GunService_TunDatagramServer) error {
-	raddr, err := net.ResolveUDPAddr("udp", g.RemoteAddr)
+// TunDatagram relays datagrams between the stream and a socket of its own.
+// On an addressed stream every hunk names the peer of its datagram, which
+// is resolved like a target, and the default upstream is optional.
+func (g *GunServiceServerImpl) TunDatagram(server proto.GunService_TunDatagramServer) error {
+	server, stop, err := shapeServer(server, true)
 	if err != nil {
 		return err
 	}
+	defer stop()
+	ctx := server.Context()
+	addressed := addressedFromContext(ctx)
+	var raddr *net.UDPAddr
+	upstream := "addressed datagrams"
+	if !addressed || targetFromContext(ctx) != "" || g.RemoteAddr != "" {
+		if upstream, err = g.upstream(ctx); err != nil {
+			return err
+		}
+		if raddr, err = net.ResolveUDPAddr("udp", upstream); err != nil {
+			return err
+		}
+	}
 	conn, err := net.ListenPacket("udp", ":0")
 	if err != nil {
 		return err
 	}
-	log.Printf("start new udp session %v <-> %v", conn.LocalAddr(), g.RemoteAddr)
-	sessionName := conn.LocalAddr().String()
-	session := ServerUdpSession{
-		LastActive: time.Now(),
-		Tun:        server,
-		Socket:     conn,
-	}
-	g.UdpSessions.Store(sessionName, session)
-
-	defer g.clearUdpSession(sessionName)
+	log.Printf("start new udp session %v <-> %v for %v", conn.LocalAddr(), upstream, describePeer(ctx))
+	session := g.udpSessions.add(conn.LocalAddr().String(), func() {
+		if err := conn.Close(); err != nil {
+			log.Printf("error when clear session %v, %v", conn.LocalAddr(), err)
+		}
+	})
+	defer g.udpSessions.remove(session)
 
-	errChan := make(chan error)
+	nat := newNatFilter(g.UdpNat)
+	var destinations *udpDestinations
+	if addressed {
+		destinations = newUdpDestinations(g.targets)
+		// the client waits for it before sending
+		policy := g.UdpNat
+		if policy == "" {
+			policy = NatPortRestricted
+		}
+		if err := server.SendHeader(metadata.Pairs(udpAddrMetadataKey, policy)); err != nil {
+			return err
+		}
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	up, down := g.rateLimits(ctx)
+	done := ctx.Done()
+	errChan := make(chan error, 2)
 
 	// up link
 	go func() {
-		defer wg.Done()
 		for {
-			if recv, err := server.Recv(); err != nil {
-				if status.Code(err) != codes.Unavailable && status.Code(err) != codes.OutOfRange {
-					// report only when not eof, eof is not error
-					errChan <- err
-				} else {
-					errChan <- nil
+			recv, err := server.Recv()
+			if err != nil {
+				if isStreamClosed(err) {
+					// report only when not eof, eof is not error, nor
+					// the client clearing its session
+					err = nil
 				}
+				errChan <- err
+				return
+			}
+			to := raddr
+			if addressed && recv.Addr != "" {
+				to = destinations.resolve(ctx, recv.Addr)
+			}
+			if to == nil {
+				continue
+			}
+			if err = ratelimit.Wait(done, len(recv.Data), up...); err != nil {
+				errChan <- err
 				return
-			} else if _, err = conn.WriteTo(recv.Data, raddr); err != nil {
+			}
+			// the header goes before each datagram, as they may arrive in
+			// any order
+			var header []byte
+			if g.SendProxyProtocol {
+				header = proxyproto.AppendV2(nil, udpAddr(streamSource(ctx)), to)
+			}
+			nat.sent(to)
+			if _, err = conn.WriteTo(append(header, recv.Data...), to); err != nil {
 				errChan <- err
 				return
 			}
-			session.LastActive = time.Now()
+			session.touch()
 		}
 	}()
 	go func() {
-		defer wg.Done()
 		buf := make([]byte, 32768)
 		for {
 			nRecv, remote, err := conn.ReadFrom(buf)
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					// the session timed out or was evicted
+					err = nil
+				}
 				errChan <- err
 				return
 			}
-			if remote.String() != raddr.String() {
+			if !nat.allows(remote) {
 				continue
 			}
-			if err = server.Send(&proto.Hunk{Data: buf[:nRecv]}); err != nil {
+			if err = ratelimit.Wait(done, nRecv, down...); err != nil {
+				errChan <- err
+				return
+			}
+			hunk := &proto.Hunk{Data: buf[:nRecv]}
+			if addressed {
+				hunk.Addr = remote.String()
+			}
+			if err = server.Send(hunk); err != nil {
 				errChan <- err
 				return
 			}
-			session.LastActive = time.Now()
+			session.touch()
 		}
 	}()
-	// wait both direction complete
-	wg.Wait()
+	// either direction completing ends the session, the deferred remove
+	// closes the socket and unblocks the other one
 	err = <-errChan
 	return err
 }
 
-func (g GunServiceServerImpl) scanInactiveSession(timeout time.Duration) {
-	tick := time.NewTicker(timeout)
-	for {
-		<-tick.C
-		needClear := make([]string, 0)
-		now := time.Now()
-		g.UdpSessions.Range(func(key, value interface{}) bool {
-			session := value.(ServerUdpSession)
-			if session.LastActive.Add(timeout).Before(now) {
-				needClear = append(needClear, key.(string))
-			}
-			return true
-		})
-
-		for _, k := range needClear {
-			g.clearUdpSession(k)
-		}
-	}
-}
-
-func (g GunServiceServerImpl) clearUdpSession(name string) {
-	s, ok := g.UdpSessions.Load(name)
-	if !ok {
-		return
-	}
-	log.Printf("clear udp session %v", name)
-	session := s.(ServerUdpSession)
-	e := session.Socket.Close()
-	if e != nil {
-		log.Printf("error when clear session %v, %v", name, e)
+// durationOr returns d, or def if d is not set.
+func durationOr(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
 	}
-	g.UdpSessions.Delete(name)
+	return d
 }
@@ -0,0 +1,329 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// shapingMetadataKey carries the Shaping a client asks for. The server
+// answers with it in its header when it shapes its side too, which tells
+// the client dummy hunks are dropped.
+const shapingMetadataKey = "gun-shaping"
+
+const (
+	// maxPadding bounds the random padding of a hunk
+	maxPadding = 4096
+	// minChunkSize and minDummyInterval keep the shaping clients ask for
+	// from costing the server too much
+	minChunkSize     = 64
+	minDummyInterval = time.Second
+)
+
+// zeroes is sliced for padding, its content does not matter under TLS. It
+// fits padding a datagram to a multiple of the largest chunk size.
+var zeroes = make([]byte, maxHunkSize+maxPadding)
+
+// Shaping hides the sizes and timing of the data carried by Tun and
+// TunDatagram streams.
+type Shaping struct {
+	// PaddingMin and PaddingMax bound the random padding added to every
+	// hunk
+	PaddingMin int
+	PaddingMax int
+	// ChunkSize splits data into hunks padded to this many bytes.
+	// Datagrams, which cannot be split, are padded to a multiple of it.
+	ChunkSize int
+	// DummyInterval sends a dummy hunk, of padding and no data, after about
+	// this long without sending
+	DummyInterval time.Duration
+}
+
+func (s Shaping) enabled() bool {
+	return s != Shaping{}
+}
+
+// Validate checks the bounds of s.
+func (s Shaping) Validate() error {
+	if s.PaddingMin < 0 || s.PaddingMax < s.PaddingMin || s.PaddingMax > maxPadding {
+		return fmt.Errorf("padding must be a range within 0-%d", maxPadding)
+	}
+	if s.ChunkSize != 0 && (s.ChunkSize < minChunkSize || s.ChunkSize > maxHunkSize) {
+		return fmt.Errorf("chunk size must be between %d and %d", minChunkSize, maxHunkSize)
+	}
+	if s.DummyInterval != 0 && s.DummyInterval < minDummyInterval {
+		return fmt.Errorf("dummy interval must be at least %v", minDummyInterval)
+	}
+	return nil
+}
+
+// String encodes s for stream metadata, like
+// "padding=16-255,chunk=1024,dummy=10s".
+func (s Shaping) String() string {
+	var fields []string
+	if s.PaddingMax > 0 {
+		fields = append(fields, fmt.Sprintf("padding=%d-%d", s.PaddingMin, s.PaddingMax))
+	}
+	if s.ChunkSize > 0 {
+		fields = append(fields, "chunk="+strconv.Itoa(s.ChunkSize))
+	}
+	if s.DummyInterval > 0 {
+		fields = append(fields, "dummy="+s.DummyInterval.String())
+	}
+	return strings.Join(fields, ",")
+}
+
+// parseShaping decodes a Shaping encoded by String. Unknown fields are
+// skipped, newer clients may ask for more.
+func parseShaping(v string) (Shaping, error) {
+	var s Shaping
+	for _, field := range strings.Split(v, ",") {
+		key, value := field, ""
+		if i := strings.IndexByte(field, '='); i >= 0 {
+			key, value = field[:i], field[i+1:]
+		}
+		var err error
+		switch key {
+		case "padding":
+			s.PaddingMin, s.PaddingMax, err = ParsePadding(value)
+		case "chunk":
+			s.ChunkSize, err = strconv.Atoi(value)
+		case "dummy":
+			s.DummyInterval, err = time.ParseDuration(value)
+		}
+		if err != nil {
+			return Shaping{}, fmt.Errorf("invalid shaping %q: %w", field, err)
+		}
+	}
+	return s, s.Validate()
+}
+
+// ParsePadding parses a padding range like "16-255", or a single number.
+func ParsePadding(v string) (min, max int, err error) {
+	lo, hi := v, v
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		lo, hi = v[:i], v[i+1:]
+	}
+	if min, err = strconv.Atoi(lo); err != nil {
+		return 0, 0, errors.New("padding must be a number or a range like 16-255")
+	}
+	if max, err = strconv.Atoi(hi); err != nil {
+		return 0, 0, errors.New("padding must be a number or a range like 16-255")
+	}
+	return min, max, nil
+}
+
+// shapedHunks shapes the hunks sent on a Tun or TunDatagram stream, and
+// drops the dummy hunks received.
+type shapedHunks struct {
+	hunkStream
+	shaping  Shaping
+	datagram bool
+
+	// sem is held while sending, which orders dummy hunks with the others.
+	// It guards the fields below.
+	sem      chan struct{}
+	rand     *rand.Rand
+	lastSend time.Time
+	// closed is set once the sending side is closed
+	closed bool
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newShapedHunks(stream hunkStream, shaping Shaping, datagram bool) *shapedHunks {
+	return &shapedHunks{
+		hunkStream: stream,
+		shaping:    shaping,
+		datagram:   datagram,
+		sem:        make(chan struct{}, 1),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		lastSend:   time.Now(),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Send sends hunk padded, split into chunks first unless it is a datagram.
+func (s *shapedHunks) Send(hunk *proto.Hunk) error {
+	s.sem <- struct{}{}
+	defer func() { <-s.sem }()
+	s.lastSend = time.Now()
+	size := s.shaping.ChunkSize
+	if s.datagram || size == 0 || len(hunk.Data) <= size {
+		return s.hunkStream.Send(s.pad(&proto.Hunk{Data: hunk.Data, Ack: hunk.Ack, Fin: hunk.Fin, Addr: hunk.Addr}))
+	}
+	for data := hunk.Data; len(data) > 0; {
+		n := len(data)
+		if n > size {
+			n = size
+		}
+		chunk := &proto.Hunk{Data: data[:n], Ack: hunk.Ack}
+		if data = data[n:]; len(data) == 0 {
+			chunk.Fin = hunk.Fin
+		}
+		if err := s.hunkStream.Send(s.pad(chunk)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pad sets the padding of hunk. It must be called with sem held.
+func (s *shapedHunks) pad(hunk *proto.Hunk) *proto.Hunk {
+	n := 0
+	if size := s.shaping.ChunkSize; size > 0 {
+		if r := len(hunk.Data) % size; r != 0 || len(hunk.Data) == 0 {
+			n = size - r
+		}
+	}
+	if max := s.shaping.PaddingMax; max > 0 {
+		n += s.shaping.PaddingMin + s.rand.Intn(max-s.shaping.PaddingMin+1)
+	}
+	hunk.Padding = zeroes[:n]
+	return hunk
+}
+
+// Recv receives the next hunk which is not a dummy. Hunks without data are
+// kept, on datagram streams they are empty datagrams.
+func (s *shapedHunks) Recv() (*proto.Hunk, error) {
+	for {
+		hunk, err := s.hunkStream.Recv()
+		if err != nil || !hunk.Dummy {
+			return hunk, err
+		}
+	}
+}
+
+// sendDummies sends a dummy hunk whenever nothing was sent for about
+// DummyInterval, until the sending side is closed or the stream ends.
+// confirm, if not nil, blocks until the peer is known to drop dummy hunks,
+// and reports false if it does not.
+func (s *shapedHunks) sendDummies(confirm func() bool) {
+	if confirm != nil && !confirm() {
+		return
+	}
+	done := s.Context().Done()
+	wait := s.shaping.DummyInterval
+	for {
+		select {
+		case <-time.After(wait):
+		case <-s.stopped:
+			return
+		case <-done:
+			return
+		}
+		select {
+		case s.sem <- struct{}{}:
+		case <-s.stopped:
+			return
+		case <-done:
+			return
+		}
+		// jittered by up to half of it, so dummies do not tick like a clock
+		interval := s.shaping.DummyInterval/2 + time.Duration(s.rand.Int63n(int64(s.shaping.DummyInterval)))
+		wait = time.Until(s.lastSend.Add(interval))
+		closed := s.closed
+		var err error
+		if wait <= 0 && !closed {
+			err = s.hunkStream.Send(s.pad(&proto.Hunk{Dummy: true}))
+			s.lastSend = time.Now()
+			wait = interval
+		}
+		<-s.sem
+		if closed || err != nil {
+			return
+		}
+	}
+}
+
+// closeSending stops dummy hunks before the sending side is closed.
+func (s *shapedHunks) closeSending() {
+	s.sem <- struct{}{}
+	s.closed = true
+	<-s.sem
+	s.stop()
+}
+
+// stop ends the dummy hunks. A dummy being sent may still complete.
+func (s *shapedHunks) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+}
+
+// shapedClient is a shaped Tun or TunDatagram client stream.
+type shapedClient struct {
+	grpc.ClientStream
+	*shapedHunks
+}
+
+// CloseSend half-closes the stream, gRPC fails sends after it.
+func (c shapedClient) CloseSend() error {
+	c.closeSending()
+	return c.ClientStream.CloseSend()
+}
+
+// shapedServer is a shaped Tun or TunDatagram server stream.
+type shapedServer struct {
+	grpc.ServerStream
+	*shapedHunks
+}
+
+// withShaping asks the server to shape streams opened with ctx like the
+// client, if Shaping is set.
+func (g *GunServiceClientImpl) withShaping(ctx context.Context) context.Context {
+	if !g.Shaping.enabled() {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, shapingMetadataKey, g.Shaping.String())
+}
+
+// shape applies Shaping to a Tun or TunDatagram stream opened with the
+// context of withShaping.
+func (g *GunServiceClientImpl) shape(stream proto.GunService_TunClient, datagram bool) proto.GunService_TunClient {
+	if !g.Shaping.enabled() {
+		return stream
+	}
+	s := newShapedHunks(stream, g.Shaping, datagram)
+	if g.Shaping.DummyInterval > 0 {
+		// servers not shaping would take dummies for empty data
+		go s.sendDummies(func() bool {
+			md, err := stream.Header()
+			return err == nil && len(md.Get(shapingMetadataKey)) > 0
+		})
+	}
+	return shapedClient{stream, s}
+}
+
+// shapeServer applies the Shaping the client asked for to a Tun or
+// TunDatagram stream. The handler calls stop when it returns.
+func shapeServer(server proto.GunService_TunServer, datagram bool) (shaped proto.GunService_TunServer, stop func(), err error) {
+	md, _ := metadata.FromIncomingContext(server.Context())
+	v := md.Get(shapingMetadataKey)
+	if len(v) == 0 {
+		return server, func() {}, nil
+	}
+	shaping, err := parseShaping(v[0])
+	if err != nil {
+		return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// sent with the first hunk, or with the header of a resumable stream
+	server.SetHeader(metadata.Pairs(shapingMetadataKey, shaping.String()))
+	s := newShapedHunks(server, shaping, datagram)
+	if shaping.DummyInterval > 0 {
+		go s.sendDummies(nil)
+	}
+	return shapedServer{server, s}, s.stop, nil
+}
@@ -0,0 +1,86 @@
+package impl
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+)
+
+// hunkPipe is a hunkStream receiving the hunks sent on it.
+type hunkPipe struct {
+	hunks []*proto.Hunk
+}
+
+func (p *hunkPipe) Send(hunk *proto.Hunk) error {
+	p.hunks = append(p.hunks, hunk)
+	return nil
+}
+
+func (p *hunkPipe) Recv() (*proto.Hunk, error) {
+	if len(p.hunks) == 0 {
+		return nil, io.EOF
+	}
+	hunk := p.hunks[0]
+	p.hunks = p.hunks[1:]
+	return hunk, nil
+}
+
+func (p *hunkPipe) Context() context.Context {
+	return context.Background()
+}
+
+func TestShapedHunksRecv(t *testing.T) {
+	shaping := Shaping{PaddingMin: 16, PaddingMax: 32, ChunkSize: 64}
+	tests := []struct {
+		name     string
+		datagram bool
+		sent     []*proto.Hunk
+		want     []*proto.Hunk
+	}{
+		{"empty datagram", true,
+			[]*proto.Hunk{{}},
+			[]*proto.Hunk{{}}},
+		{"empty addressed datagram", true,
+			[]*proto.Hunk{{Addr: "192.0.2.1:53"}},
+			[]*proto.Hunk{{Addr: "192.0.2.1:53"}}},
+		{"dummy between datagrams", true,
+			[]*proto.Hunk{{Data: []byte("a")}, {Dummy: true}, {}},
+			[]*proto.Hunk{{Data: []byte("a")}, {}}},
+		{"dummy between data", false,
+			[]*proto.Hunk{{Data: []byte("a")}, {Dummy: true}, {Data: []byte("b")}},
+			[]*proto.Hunk{{Data: []byte("a")}, {Data: []byte("b")}}},
+		{"ack alone", false,
+			[]*proto.Hunk{{Ack: 10}, {Fin: true}},
+			[]*proto.Hunk{{Ack: 10}, {Fin: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipe := &hunkPipe{}
+			s := newShapedHunks(pipe, shaping, tt.datagram)
+			for _, hunk := range tt.sent {
+				if hunk.Dummy {
+					pipe.Send(s.pad(&proto.Hunk{Dummy: true}))
+				} else if err := s.Send(hunk); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, want := range tt.want {
+				got, err := s.Recv()
+				if err != nil {
+					t.Fatalf("hunk %d: %v", i, err)
+				}
+				if string(got.Data) != string(want.Data) || got.Addr != want.Addr || got.Ack != want.Ack || got.Fin != want.Fin {
+					t.Fatalf("hunk %d: got %v, want %v", i, got, want)
+				}
+				if len(got.Padding) == 0 {
+					t.Fatalf("hunk %d not padded", i)
+				}
+			}
+			if got, err := s.Recv(); err != io.EOF {
+				t.Fatalf("got %v, %v after the last hunk", got, err)
+			}
+		})
+	}
+}
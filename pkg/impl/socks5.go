@@ -0,0 +1,354 @@
+package impl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	socks5Version = 5
+
+	socks5NoAuth       = 0
+	socks5NoAcceptable = 0xff
+
+	socks5Connect      = 1
+	socks5Bind         = 2
+	socks5UdpAssociate = 3
+
+	socks5AtypIPv4   = 1
+	socks5AtypDomain = 3
+	socks5AtypIPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5NotAllowed          = 2
+	socks5HostUnreachable     = 4
+	socks5ConnectionRefused   = 5
+	socks5CommandNotSupported = 7
+	socks5AtypNotSupported    = 8
+)
+
+var errSocks5AtypNotSupported = errors.New("socks5 address type not supported")
+
+// readSocksAddr reads ATYP, DST.ADDR and DST.PORT and returns them as
+// host:port.
+func readSocksAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errSocks5AtypNotSupported
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSocksAddr appends addr, a host:port, encoded as ATYP, DST.ADDR and
+// DST.PORT.
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long: %v", host)
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// serveSocks5 handles a SOCKS5 client on an accepted local connection.
+func (g *GunServiceClientImpl) serveSocks5(local net.Conn) {
+	// greeting, only no authentication is supported
+	var header [2]byte
+	if _, err := io.ReadFull(local, header[:]); err != nil {
+		log.Printf("failed to read socks5 greeting: %v", err)
+		return
+	}
+	if header[0] != socks5Version {
+		log.Printf("unsupported socks version %v from %v", header[0], local.RemoteAddr())
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(local, methods); err != nil {
+		log.Printf("failed to read socks5 greeting: %v", err)
+		return
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := local.Write([]byte{socks5Version, method}); err != nil || method == socks5NoAcceptable {
+		return
+	}
+
+	// request
+	var request [3]byte
+	if _, err := io.ReadFull(local, request[:]); err != nil {
+		log.Printf("failed to read socks5 request: %v", err)
+		return
+	}
+	target, err := readSocksAddr(local)
+	if err != nil {
+		if err == errSocks5AtypNotSupported {
+			writeSocks5Reply(local, socks5AtypNotSupported, nil)
+		}
+		log.Printf("failed to read socks5 request: %v", err)
+		return
+	}
+
+	switch request[1] {
+	case socks5Connect:
+		tun, err := g.openTun(withSource(g.ctx, local.RemoteAddr()), target)
+		if err != nil {
+			log.Printf("failed to create context: %v", err)
+			writeSocks5Reply(local, socks5ReplyCode(err), nil)
+			return
+		}
+		if err := g.waitDialed(tun); err != nil {
+			log.Printf("failed to connect %v: %v", target, err)
+			writeSocks5Reply(local, socks5ReplyCode(err), nil)
+			return
+		}
+		if err := writeSocks5Reply(local, socks5Succeeded, nil); err != nil {
+			closeSend(tun)
+			return
+		}
+		g.pipe(local, tun)
+	case socks5UdpAssociate:
+		g.serveSocks5Udp(local)
+	default:
+		writeSocks5Reply(local, socks5CommandNotSupported, nil)
+	}
+}
+
+// socks5ReplyCode maps the status of a stream which failed to connect, see
+// dialError.
+func socks5ReplyCode(err error) byte {
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		return socks5NotAllowed
+	case codes.NotFound, codes.DeadlineExceeded:
+		return socks5HostUnreachable
+	case codes.Unavailable:
+		return socks5ConnectionRefused
+	}
+	return socks5GeneralFailure
+}
+
+func writeSocks5Reply(w io.Writer, rep byte, bound net.Addr) error {
+	reply := []byte{socks5Version, rep, 0}
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	reply, err := appendSocksAddr(reply, addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(reply)
+	return err
+}
+
+// socks5UdpStream is the stream of one destination of a UDP association.
+type socks5UdpStream struct {
+	tun    proto.GunService_TunDatagramClient
+	cancel context.CancelFunc
+}
+
+// serveSocks5Udp relays an UDP association until its control connection is
+// closed. Datagrams go over one addressed TunDatagram stream, so replies
+// from any peer the server lets through keep their source. With older
+// servers, each destination gets its own stream instead.
+func (g *GunServiceClientImpl) serveSocks5Udp(control net.Conn) {
+	localIP := control.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		log.Printf("failed to listen socks5 udp relay: %v", err)
+		writeSocks5Reply(control, socks5GeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	if err := writeSocks5Reply(control, socks5Succeeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	log.Printf("socks5 udp associate: %v <-> %v", relay.LocalAddr(), control.RemoteAddr())
+
+	ctx, cancel := context.WithCancel(g.ctx)
+	defer cancel()
+
+	// the association lives as long as the control connection, or the
+	// client
+	go func() {
+		io.Copy(io.Discard, control)
+		cancel()
+	}()
+	stopClosing := closeOnDone(ctx, relay)
+	defer stopClosing()
+
+	clientIP := control.RemoteAddr().(*net.TCPAddr).IP
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var client net.Addr
+	var addressed proto.GunService_TunDatagramClient
+	var closeAddressed context.CancelFunc
+	// sessions holds the stream of each destination once the association
+	// fell back to them
+	var sessions map[string]socks5UdpStream
+	defer func() {
+		// ends the streams for the down links to return
+		cancel()
+		wg.Wait()
+	}()
+
+	// down link, datagrams come from target unless they carry their source
+	down := func(tun proto.GunService_TunDatagramClient, target string) {
+		defer wg.Done()
+		for {
+			recv, err := tun.Recv()
+			if err != nil {
+				if !isStreamClosed(err) {
+					log.Printf("remote read packet conn closed: %v", err)
+				}
+				return
+			}
+			source := target
+			if recv.Addr != "" {
+				source = recv.Addr
+			}
+			packet, err := appendSocksAddr([]byte{0, 0, 0}, source)
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			to := client
+			mu.Unlock()
+			if _, err := relay.WriteTo(append(packet, recv.Data...), to); err != nil {
+				return
+			}
+		}
+	}
+
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// only accept datagrams from the host which asked for the association
+		if !from.(*net.UDPAddr).IP.Equal(clientIP) {
+			continue
+		}
+		mu.Lock()
+		client = from
+		mu.Unlock()
+
+		// RSV(2) FRAG(1), fragmentation is not supported
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		packet := bytes.NewReader(buf[3:n])
+		target, err := readSocksAddr(packet)
+		if err != nil {
+			continue
+		}
+		data := buf[n-packet.Len() : n]
+
+		if addressed == nil && sessions == nil {
+			addressed, closeAddressed, err = g.openAddressedDatagram(withSource(ctx, from))
+			if err != nil {
+				if err != errUdpAddrUnsupported {
+					log.Printf("failed to open addressed datagram stream: %v", err)
+				}
+				sessions = make(map[string]socks5UdpStream)
+			} else {
+				wg.Add(1)
+				go down(addressed, "")
+			}
+		}
+		if addressed != nil {
+			if err := addressed.Send(&proto.Hunk{Data: data, Addr: target}); err != nil {
+				log.Printf("remote write packet conn closed: %v", err)
+				// opened again by the next datagram
+				closeAddressed()
+				addressed = nil
+			}
+			continue
+		}
+
+		session, ok := sessions[target]
+		if !ok {
+			var tunCtx context.Context
+			tunCtx, session.cancel = context.WithCancel(ctx)
+			session.tun, err = g.openDatagram(withSource(tunCtx, from), target)
+			if err != nil {
+				session.cancel()
+				log.Printf("failed to create context: %v", err)
+				continue
+			}
+			sessions[target] = session
+			wg.Add(1)
+			go down(session.tun, target)
+		}
+		if err := session.tun.Send(&proto.Hunk{Data: data}); err != nil {
+			log.Printf("remote write packet conn closed: %v", err)
+			// opened again by the next datagram
+			session.cancel()
+			delete(sessions, target)
+		}
+	}
+}
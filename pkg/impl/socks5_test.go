@@ -0,0 +1,218 @@
+package impl
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+)
+
+// tcpEcho serves a TCP echo on loopback until the test ends.
+func tcpEcho(t *testing.T) net.Addr {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr()
+}
+
+// closedPort returns a loopback address nothing listens on.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// startTargetServer starts a server allowing loopback targets, and returns
+// its address.
+func startTargetServer(t *testing.T) string {
+	t.Helper()
+	server := &GunServiceServerImpl{
+		LocalAddr:      "127.0.0.1:0",
+		Cleartext:      true,
+		ServiceName:    "S",
+		AllowedTargets: []string{"127.0.0.0/8"},
+	}
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return server.listener.Addr().String()
+}
+
+func TestSocks5ConnectReply(t *testing.T) {
+	echo := tcpEcho(t)
+	g := &GunServiceClientImpl{Inbound: InboundSocks5}
+	proxy := startClient(t, g, startTargetServer(t))
+
+	tests := []struct {
+		name   string
+		target string
+		want   byte
+	}{
+		{"allowed", echo.String(), socks5Succeeded},
+		{"denied", "10.0.0.1:80", socks5NotAllowed},
+		{"refused", closedPort(t), socks5ConnectionRefused},
+		{"unresolvable", "gun.invalid:80", socks5HostUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxy.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			request := []byte{socks5Version, 1, socks5NoAuth, socks5Version, socks5Connect, 0}
+			request, err = appendSocksAddr(request, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(request); err != nil {
+				t.Fatal(err)
+			}
+			var reply [2 + 10]byte
+			if _, err := io.ReadFull(conn, reply[:]); err != nil {
+				t.Fatal(err)
+			}
+			if got := reply[3]; got != tt.want {
+				t.Fatalf("reply %#x, want %#x", got, tt.want)
+			}
+			if tt.want != socks5Succeeded {
+				return
+			}
+			if !exchange(conn, "hello") {
+				t.Fatal("no echo")
+			}
+		})
+	}
+}
+
+// socks5Associate asks proxy for a UDP association, and returns the control
+// connection and a socket talking to the relay.
+func socks5Associate(t *testing.T, proxy net.Addr) (net.Conn, net.Conn) {
+	t.Helper()
+	control, err := net.Dial("tcp", proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { control.Close() })
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	request := []byte{socks5Version, 1, socks5NoAuth, socks5Version, socks5UdpAssociate, 0}
+	if request, err = appendSocksAddr(request, "0.0.0.0:0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := control.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	var reply [5]byte
+	if _, err := io.ReadFull(control, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(control, reply[:3]); err != nil || reply[1] != socks5Succeeded {
+		t.Fatalf("associate reply %v, %v", reply[:3], err)
+	}
+	relay, err := readSocksAddr(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return control, conn
+}
+
+// socks5Exchange sends msg to target through the relay on conn, and reports
+// whether it is echoed back.
+func socks5Exchange(t *testing.T, conn net.Conn, target, msg string) bool {
+	t.Helper()
+	packet, err := appendSocksAddr([]byte{0, 0, 0}, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(packet)
+	if _, err := conn.Write(append(packet, msg...)); err != nil {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	return err == nil && n >= header && string(buf[header:n]) == msg
+}
+
+func TestSocks5UdpReopensFailedStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// answers no addressed streams, the association falls back to a stream
+	// per destination
+	server := &failingServer{}
+	gs := grpc.NewServer()
+	proto.RegisterGunServiceServerX(gs, server, "S")
+	go gs.Serve(listener)
+	defer gs.Stop()
+
+	g := &GunServiceClientImpl{Inbound: InboundSocks5, ConnectTimeout: 100 * time.Millisecond}
+	_, conn := socks5Associate(t, startClient(t, g, listener.Addr().String()))
+
+	const target = "192.0.2.1:53"
+	if !socks5Exchange(t, conn, target, "first") {
+		t.Fatal("no echo on the first stream")
+	}
+	// the failed stream is found out by a send, a later datagram opens
+	// another one
+	deadline := time.Now().Add(3 * time.Second)
+	for !socks5Exchange(t, conn, target, "again") {
+		if time.Now().After(deadline) {
+			t.Fatal("no echo after the stream failed")
+		}
+	}
+	// the addressed stream and two of the destination
+	if got := atomic.LoadInt32(&server.streams); got != 3 {
+		t.Fatalf("%d streams opened, want 3", got)
+	}
+}
+
+func TestSocks5UdpShutdown(t *testing.T) {
+	g := &GunServiceClientImpl{Inbound: InboundSocks5}
+	proxy := startClient(t, g, startTargetServer(t))
+	socks5Associate(t, proxy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := g.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown: %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("shutdown took %v", elapsed)
+	}
+}
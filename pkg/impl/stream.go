@@ -0,0 +1,298 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxHunkSize = 32768
+	// a multi hunk coalesces at most this many reads
+	maxMultiHunkCount = 16
+)
+
+// tunStream is either end of a Tun or TunMulti stream, seen as a sequence
+// of hunks.
+type tunStream interface {
+	send(data [][]byte) error
+	recv() ([][]byte, error)
+	// multi reports whether several hunks travel in one message
+	multi() bool
+	Context() context.Context
+}
+
+type hunkStream interface {
+	Send(*proto.Hunk) error
+	Recv() (*proto.Hunk, error)
+	Context() context.Context
+}
+
+type multiHunkStream interface {
+	Send(*proto.MultiHunk) error
+	Recv() (*proto.MultiHunk, error)
+	Context() context.Context
+}
+
+// hunkTun wraps a Tun stream.
+type hunkTun struct {
+	hunkStream
+}
+
+func (s hunkTun) send(data [][]byte) error {
+	for _, d := range data {
+		if err := s.Send(&proto.Hunk{Data: d}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s hunkTun) recv() ([][]byte, error) {
+	hunk, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{hunk.Data}, nil
+}
+
+func (s hunkTun) multi() bool {
+	return false
+}
+
+// multiHunkTun wraps a TunMulti stream.
+type multiHunkTun struct {
+	multiHunkStream
+}
+
+func (s multiHunkTun) send(data [][]byte) error {
+	return s.Send(&proto.MultiHunk{Data: data})
+}
+
+func (s multiHunkTun) recv() ([][]byte, error) {
+	hunk, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return hunk.Data, nil
+}
+
+func (s multiHunkTun) multi() bool {
+	return true
+}
+
+// closeSend half-closes the stream if it is a client stream.
+func closeSend(s tunStream) error {
+	var stream interface{}
+	switch s := s.(type) {
+	case hunkTun:
+		stream = s.hunkStream
+	case multiHunkTun:
+		stream = s.multiHunkStream
+	case *resumableTun:
+		return s.closeSend()
+	}
+	if cs, ok := stream.(grpc.ClientStream); ok {
+		return cs.CloseSend()
+	}
+	return nil
+}
+
+// isStreamClosed reports whether err is the normal end of a stream.
+func isStreamClosed(err error) bool {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.OutOfRange, codes.Canceled:
+		return true
+	}
+	return false
+}
+
+// errNoAnswer fails waitHeader when the header does not arrive in time.
+var errNoAnswer = status.Error(codes.Unavailable, "server did not answer")
+
+// waitHeader waits up to timeout for the header of a stream the server
+// answers right away.
+func waitHeader(stream grpc.ClientStream, timeout time.Duration) (metadata.MD, error) {
+	type header struct {
+		md  metadata.MD
+		err error
+	}
+	answer := make(chan header, 1)
+	go func() {
+		md, err := stream.Header()
+		answer <- header{md, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h := <-answer:
+		return h.md, h.err
+	case <-timer.C:
+		return nil, errNoAnswer
+	}
+}
+
+// dialedMetadataKey is in the header of a Tun or TunMulti stream once the
+// server connected to its upstream.
+const dialedMetadataKey = "gun-dialed"
+
+// waitDialed waits until the server of tun connected to its upstream, and
+// returns the status of the stream if it could not. Older servers send no
+// header before the first data, tun is taken as connected when the server
+// does not answer in time.
+func (g *GunServiceClientImpl) waitDialed(tun tunStream) error {
+	var stream grpc.ClientStream
+	switch s := tun.(type) {
+	case hunkTun:
+		stream, _ = s.hunkStream.(grpc.ClientStream)
+	case multiHunkTun:
+		stream, _ = s.multiHunkStream.(grpc.ClientStream)
+	}
+	if stream == nil {
+		// resumable streams are accepted once connected
+		return nil
+	}
+	md, err := waitHeader(stream, durationOr(g.ConnectTimeout, 5*time.Second))
+	if err == errNoAnswer {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		// errors come without headers
+		if err := stream.RecvMsg(new(proto.Hunk)); err != io.EOF {
+			return err
+		}
+		return status.Error(codes.Unavailable, "stream closed")
+	}
+	return nil
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, maxHunkSize)
+	},
+}
+
+// copyToStream sends everything read from src to dst until src reaches EOF.
+// Reads arriving while a send is in flight are coalesced into one message
+// when dst is a multi stream.
+func copyToStream(dst tunStream, src io.Reader) error {
+	if !dst.multi() {
+		buf := make([]byte, maxHunkSize)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if err := dst.send([][]byte{buf[:n]}); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	reads := make(chan []byte, maxMultiHunkCount)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(reads)
+		for {
+			buf := bufferPool.Get().([]byte)
+			n, err := src.Read(buf)
+			if n > 0 {
+				select {
+				case reads <- buf[:n]:
+				case <-done:
+					return
+				}
+			} else {
+				bufferPool.Put(buf)
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+		}
+	}()
+
+	data := make([][]byte, 0, maxMultiHunkCount)
+	for {
+		buf, ok := <-reads
+		if !ok {
+			select {
+			case err := <-readErr:
+				return err
+			default:
+				return nil
+			}
+		}
+		data = append(data[:0], buf)
+	coalesce:
+		for len(data) < maxMultiHunkCount {
+			select {
+			case buf, ok := <-reads:
+				if !ok {
+					break coalesce
+				}
+				data = append(data, buf)
+			default:
+				break coalesce
+			}
+		}
+		err := dst.send(data)
+		for _, buf := range data {
+			bufferPool.Put(buf[:cap(buf)])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyFromStream writes everything received from src to dst until the peer
+// closes its sending side.
+func copyFromStream(dst io.Writer, src tunStream) error {
+	for {
+		data, err := src.recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, d := range data {
+			if _, err := dst.Write(d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// closeWrite shuts down the writing side of conn when supported, and closes
+// it otherwise.
+func closeWrite(conn io.Closer) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return conn.Close()
+}
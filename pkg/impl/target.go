@@ -0,0 +1,213 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// targetMetadataKey carries the host:port a client wants the server to dial
+// for a stream.
+const targetMetadataKey = "gun-target"
+
+// withTarget attaches target to the outgoing stream context.
+func withTarget(ctx context.Context, target string) context.Context {
+	if target == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, targetMetadataKey, target)
+}
+
+// targetFromContext returns the target a client asked for, if any.
+func targetFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(targetMetadataKey); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// targetRule matches destinations by host name, IP network and port range.
+type targetRule struct {
+	// host is a lower case domain, "*.example.com" matches subdomains, empty
+	// matches any host
+	host    string
+	network *net.IPNet
+	portMin int
+	portMax int
+}
+
+// targetPolicy is the allow-list of destinations clients may ask for.
+type targetPolicy []targetRule
+
+// parseTargetPolicy parses allow-list entries. An entry is a host name, IP
+// or CIDR, optionally followed by a port or port range, e.g. "example.com",
+// "10.0.0.0/8:22", "[fd00::/8]:443", "*.internal:8000-9000" or ":443".
+// "*" allows everything.
+func parseTargetPolicy(entries []string) (targetPolicy, error) {
+	policy := make(targetPolicy, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rule, err := parseTargetRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed target %q: %w", entry, err)
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+func parseTargetRule(entry string) (targetRule, error) {
+	rule := targetRule{portMin: 0, portMax: 65535}
+	if entry == "*" {
+		return rule, nil
+	}
+
+	host, port := entry, ""
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		host, port = h, p
+	} else if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+		host = entry[1 : len(entry)-1]
+	}
+
+	if port != "" && port != "*" {
+		parts := strings.SplitN(port, "-", 2)
+		min, err := strconv.Atoi(parts[0])
+		if err != nil || min < 0 || min > 65535 {
+			return rule, fmt.Errorf("bad port %q", parts[0])
+		}
+		max := min
+		if len(parts) == 2 {
+			max, err = strconv.Atoi(parts[1])
+			if err != nil || max < min || max > 65535 {
+				return rule, fmt.Errorf("bad port range %q", port)
+			}
+		}
+		rule.portMin, rule.portMax = min, max
+	}
+
+	switch {
+	case host == "" || host == "*":
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule, err
+		}
+		rule.network = network
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		if !isHostPattern(host) {
+			return rule, fmt.Errorf("bad host %q", host)
+		}
+		rule.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return rule, nil
+}
+
+// isHostPattern reports whether host is a domain, optionally starting with
+// "*." to match its subdomains.
+func isHostPattern(host string) bool {
+	host = strings.TrimPrefix(host, "*.")
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" {
+			return false
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r targetRule) matchPort(port int) bool {
+	return port >= r.portMin && port <= r.portMax
+}
+
+func (r targetRule) matchHost(host string) bool {
+	if r.network != nil {
+		return false
+	}
+	if r.host == "" {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(r.host, "*.") {
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+func (r targetRule) matchIP(ip net.IP) bool {
+	if r.network == nil {
+		return r.host == ""
+	}
+	return r.network.Contains(ip)
+}
+
+// resolve checks target against the policy and returns the address to dial.
+// Host names only allowed through IP rules are resolved here, and the
+// matching address is returned so the check can't be bypassed by rebinding.
+func (p targetPolicy) resolve(ctx context.Context, target string) (string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid target %q: %v", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", status.Errorf(codes.InvalidArgument, "invalid target port %q", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, r := range p {
+			if r.matchPort(port) && r.matchIP(ip) {
+				return target, nil
+			}
+		}
+		return "", status.Errorf(codes.PermissionDenied, "target %v is not allowed", target)
+	}
+
+	ipRules := false
+	for _, r := range p {
+		if !r.matchPort(port) {
+			continue
+		}
+		if r.matchHost(host) {
+			return target, nil
+		}
+		ipRules = ipRules || r.network != nil
+	}
+	if ipRules {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", status.Errorf(codes.NotFound, "failed to resolve target %v: %v", target, err)
+		}
+		for _, addr := range addrs {
+			for _, r := range p {
+				if r.matchPort(port) && r.matchIP(addr.IP) {
+					return net.JoinHostPort(addr.IP.String(), portStr), nil
+				}
+			}
+		}
+	}
+	return "", status.Errorf(codes.PermissionDenied, "target %v is not allowed", target)
+}
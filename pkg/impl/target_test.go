@@ -0,0 +1,110 @@
+package impl
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseTargetPolicyMalformed(t *testing.T) {
+	entries := []string{
+		"10.0.0.0/33",
+		"10.0.0.0/8/8",
+		"fd00::/129",
+		"[fd00::/8",
+		"example.com:65536",
+		"example.com:-1",
+		"example.com:http",
+		"example.com:443-80",
+		"example.com:80-65536",
+		"example.com:80-",
+		"example.com:443:1",
+		"exa mple.com",
+		"example..com",
+		"*.*.example.com",
+		"example.*",
+	}
+	for _, entry := range entries {
+		t.Run(entry, func(t *testing.T) {
+			if _, err := parseTargetPolicy([]string{"example.org", entry}); err == nil {
+				t.Fatal("accepted")
+			}
+			server := &GunServiceServerImpl{
+				LocalAddr:      "127.0.0.1:0",
+				RemoteAddr:     "127.0.0.1:1",
+				Cleartext:      true,
+				ServiceName:    "S",
+				AllowedTargets: []string{entry},
+			}
+			if err := server.Start(context.Background()); err == nil {
+				server.Shutdown(context.Background())
+				t.Fatal("server started")
+			}
+		})
+	}
+}
+
+func TestTargetPolicyResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		target  string
+		// want is the address to dial, empty if target is rejected with
+		// wantCode
+		want     string
+		wantCode codes.Code
+	}{
+		{"apex", []string{"example.com"}, "example.com:443", "example.com:443", codes.OK},
+		{"apex case and trailing dot", []string{"Example.COM."}, "EXAMPLE.com.:443", "EXAMPLE.com.:443", codes.OK},
+		{"apex not subdomain", []string{"example.com"}, "www.example.com:443", "", codes.PermissionDenied},
+		{"wildcard subdomain", []string{"*.example.com"}, "www.example.com:443", "www.example.com:443", codes.OK},
+		{"wildcard deep subdomain", []string{"*.example.com"}, "a.b.example.com:443", "a.b.example.com:443", codes.OK},
+		{"wildcard not apex", []string{"*.example.com"}, "example.com:443", "", codes.PermissionDenied},
+		{"wildcard not suffix", []string{"*.example.com"}, "badexample.com:443", "", codes.PermissionDenied},
+		{"wildcard and apex", []string{"example.com", "*.example.com"}, "example.com:443", "example.com:443", codes.OK},
+
+		{"port range below", []string{"example.com:1000-2000"}, "example.com:999", "", codes.PermissionDenied},
+		{"port range min", []string{"example.com:1000-2000"}, "example.com:1000", "example.com:1000", codes.OK},
+		{"port range max", []string{"example.com:1000-2000"}, "example.com:2000", "example.com:2000", codes.OK},
+		{"port range above", []string{"example.com:1000-2000"}, "example.com:2001", "", codes.PermissionDenied},
+		{"single port", []string{"example.com:22"}, "example.com:23", "", codes.PermissionDenied},
+		{"any host port", []string{":443"}, "203.0.113.1:443", "203.0.113.1:443", codes.OK},
+		{"highest port", []string{"*"}, "example.com:65535", "example.com:65535", codes.OK},
+		{"port zero", []string{"*"}, "example.com:0", "", codes.InvalidArgument},
+		{"port out of range", []string{"*"}, "example.com:65536", "", codes.InvalidArgument},
+		{"no port", []string{"*"}, "example.com", "", codes.InvalidArgument},
+
+		{"ipv4 cidr", []string{"10.0.0.0/8"}, "10.1.2.3:22", "10.1.2.3:22", codes.OK},
+		{"ipv4 outside cidr", []string{"10.0.0.0/8"}, "11.0.0.1:22", "", codes.PermissionDenied},
+		{"ipv6 cidr", []string{"[2001:db8::/32]:443"}, "[2001:db8::1]:443", "[2001:db8::1]:443", codes.OK},
+		{"ipv6 cidr other port", []string{"[2001:db8::/32]:443"}, "[2001:db8::1]:80", "", codes.PermissionDenied},
+		{"ipv6 outside cidr", []string{"[2001:db8::/32]:443"}, "[2001:db9::1]:443", "", codes.PermissionDenied},
+		{"ipv6 cidr without port", []string{"[fd00::/8]"}, "[fd12::1]:53", "[fd12::1]:53", codes.OK},
+		{"ipv6 address", []string{"[::1]:22"}, "[::1]:22", "[::1]:22", codes.OK},
+		{"ipv6 address not ipv4", []string{"[::1]:22"}, "127.0.0.1:22", "", codes.PermissionDenied},
+		{"ip not by host rule", []string{"example.com"}, "10.0.0.1:443", "", codes.PermissionDenied},
+
+		// a host name only allowed through IP rules is dialed at the
+		// address it was checked with
+		{"host resolving into cidr", []string{"127.0.0.0/8:80"}, "localhost:80", "127.0.0.1:80", codes.OK},
+		{"host resolving outside cidr", []string{"10.0.0.0/8"}, "localhost:80", "", codes.PermissionDenied},
+		{"host resolving into cidr other port", []string{"127.0.0.0/8:80"}, "localhost:81", "", codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := parseTargetPolicy(tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := policy.resolve(context.Background(), tt.target)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("resolved %q with %v, want %v", got, err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Fatalf("resolved %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package impl
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/Qv2ray/gun/pkg/cert"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// serverTLSConfig builds the TLS configuration of the server, requiring
+// client certificates when ClientCAPath is set. The certificate pair is
+// served by a reloader, so renewals apply to new connections only.
+func (g *GunServiceServerImpl) serverTLSConfig() (*tls.Config, error) {
+	keyPair, err := cert.NewKeyPairReloader(g.CertPath, g.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	g.keyPair = keyPair
+
+	config := &tls.Config{GetCertificate: keyPair.GetCertificate}
+	if g.ClientCAPath != "" {
+		pool, err := loadCertPool(g.ClientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %w", err)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientTLSConfig builds the TLS configuration of the client for the server
+// at addr, presenting a client certificate when CertPath is set.
+func (g *GunServiceClientImpl) clientTLSConfig(addr, serverName string) (*tls.Config, error) {
+	roots, err := cert.GetSystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system certificate pool: %w", err)
+	}
+	if g.CAPath != "" {
+		pem, err := ioutil.ReadFile(g.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to read CA: no certificate found in %v", g.CAPath)
+		}
+	}
+	pins, err := parsePins(g.PinnedKeys)
+	if err != nil {
+		return nil, err
+	}
+	if g.Insecure {
+		log.Println("certificate verification is disabled, the connection is not secure")
+	}
+
+	// gRPC would default to the host of the authority as well, but the
+	// verifier needs it since SNI is not sent for IP addresses
+	if serverName == "" {
+		serverName = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			serverName = host
+		}
+	}
+
+	v := &serverVerifier{serverName: serverName, roots: roots, pins: pins, insecure: g.Insecure}
+	config := &tls.Config{
+		ServerName: serverName,
+		// the chain is verified by serverVerifier instead, to apply pins and
+		// explain failures
+		InsecureSkipVerify: true,
+		VerifyConnection:   v.verify,
+	}
+	if g.CertPath != "" || g.KeyPath != "" {
+		pair, err := tls.LoadX509KeyPair(g.CertPath, g.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// parsePins decodes SHA-256 SPKI pins, base64 encoded and optionally
+// prefixed with "sha256/" as in HPKP.
+func parsePins(pins []string) ([][]byte, error) {
+	decoded := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if pin == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q, expect base64 of a SHA-256 hash", pin)
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded, nil
+}
+
+// spkiHash returns the pin of a certificate.
+func spkiHash(c *x509.Certificate) []byte {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+type serverVerifier struct {
+	serverName string
+	roots      *x509.CertPool
+	pins       [][]byte
+	insecure   bool
+}
+
+// verify checks the certificate chain of the server unless insecure, then
+// requires one of its keys to be pinned if there are pins. Without chain
+// verification only the key of the leaf certificate can match a pin.
+func (v *serverVerifier) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+
+	candidates := []*x509.Certificate{leaf}
+	if !v.insecure {
+		intermediates := x509.NewCertPool()
+		for _, c := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		chains, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       v.serverName,
+			Roots:         v.roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to verify certificate of %v issued by %q for %v against the system and configured CAs: %w",
+				v.serverName, leaf.Issuer.String(), leaf.DNSNames, err)
+		}
+		candidates = chains[0]
+	}
+
+	if len(v.pins) == 0 {
+		return nil
+	}
+	presented := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		hash := spkiHash(c)
+		for _, pin := range v.pins {
+			if subtle.ConstantTimeCompare(hash, pin) == 1 {
+				return nil
+			}
+		}
+		presented = append(presented, "sha256/"+base64.StdEncoding.EncodeToString(hash))
+	}
+	return fmt.Errorf("no key of the certificate of %v is pinned, presented %v", v.serverName, strings.Join(presented, ", "))
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + path)
+	}
+	return pool, nil
+}
+
+// PeerCertificate returns the verified client certificate of a stream, if
+// the server requires client certificates.
+func PeerCertificate(ctx context.Context) (*x509.Certificate, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return info.State.VerifiedChains[0][0], true
+}
+
+// authenticated reports whether a stream was opened by a known user or
+// with a verified client certificate.
+func authenticated(ctx context.Context) bool {
+	if _, ok := UserFromContext(ctx); ok {
+		return true
+	}
+	_, ok := PeerCertificate(ctx)
+	return ok
+}
+
+// identity describes who opened a stream, for logging and authorization.
+// The user authenticated with a token comes first, then the subject of the
+// client certificate.
+func identity(ctx context.Context) string {
+	if user, ok := UserFromContext(ctx); ok {
+		return user
+	}
+	if c, ok := PeerCertificate(ctx); ok {
+		return c.Subject.String()
+	}
+	return ""
+}
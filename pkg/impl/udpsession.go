@@ -0,0 +1,137 @@
+package impl
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpSession is an entry of a udpTable.
+type udpSession struct {
+	// lastActive is the time of the last datagram either way, in Unix
+	// nanoseconds. It is updated for every datagram, so atomically rather
+	// than under the lock of the table. First for 64-bit alignment.
+	lastActive int64
+	key        string
+	// close releases the stream or socket of the session, once it is out
+	// of the table
+	close func()
+	// client relays a session of the client
+	client *clientUdpSession
+}
+
+// touch records activity on the session.
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// udpTable holds the UDP sessions of a client or server by key. Sessions
+// idle for longer than timeout are closed, and when max sessions are open
+// the least recently active one makes room for a new one.
+type udpTable struct {
+	side    string
+	timeout time.Duration
+	max     int
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func newUdpTable(side string, timeout time.Duration, max int) *udpTable {
+	return &udpTable{side: side, timeout: timeout, max: max, sessions: make(map[string]*udpSession)}
+}
+
+// get returns the session of key, nil if there is none.
+func (t *udpTable) get(key string) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[key]
+}
+
+// add opens a session under key, which must not be taken, closed by close.
+func (t *udpTable) add(key string, close func()) *udpSession {
+	s := &udpSession{key: key, close: close}
+	s.touch()
+	var evicted *udpSession
+	t.mu.Lock()
+	if t.max > 0 && len(t.sessions) >= t.max {
+		now := time.Now()
+		for _, other := range t.sessions {
+			if evicted == nil || other.idle(now) > evicted.idle(now) {
+				evicted = other
+			}
+		}
+		delete(t.sessions, evicted.key)
+	}
+	t.sessions[key] = s
+	t.mu.Unlock()
+
+	if evicted != nil {
+		log.Printf("evict udp session %v idle for %v", evicted.key, evicted.idle(time.Now()).Round(time.Millisecond))
+		evicted.close()
+	} else {
+		udpSessionsActive.With(t.side).Inc()
+	}
+	return s
+}
+
+// remove closes s, unless it was removed already.
+func (t *udpTable) remove(s *udpSession) {
+	t.mu.Lock()
+	ok := t.sessions[s.key] == s
+	if ok {
+		delete(t.sessions, s.key)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	udpSessionsActive.With(t.side).Dec()
+	log.Printf("clear udp session %v", s.key)
+	s.close()
+}
+
+// expire closes the sessions idle for longer than the timeout until ctx is
+// done. A session is closed at most half the timeout late.
+func (t *udpTable) expire(ctx context.Context) {
+	tick := time.NewTicker(t.timeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		var idle []*udpSession
+		now := time.Now()
+		t.mu.Lock()
+		for _, s := range t.sessions {
+			if s.idle(now) > t.timeout {
+				idle = append(idle, s)
+			}
+		}
+		t.mu.Unlock()
+		for _, s := range idle {
+			t.remove(s)
+		}
+	}
+}
+
+// closeAll closes every session.
+func (t *udpTable) closeAll() {
+	t.mu.Lock()
+	sessions := make([]*udpSession, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.mu.Unlock()
+	for _, s := range sessions {
+		t.remove(s)
+	}
+}
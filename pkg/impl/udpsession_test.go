@@ -0,0 +1,237 @@
+package impl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Qv2ray/gun/pkg/metrics"
+)
+
+// gaugeValue reads the gun_udp_sessions_active gauge of side from the
+// default registry.
+func gaugeValue(t *testing.T, side string) float64 {
+	t.Helper()
+	var b bytes.Buffer
+	if err := metrics.Default.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	prefix := `gun_udp_sessions_active{side="` + side + `"} `
+	scanner := bufio.NewScanner(&b)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, prefix) {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(line, prefix), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+// closeCounter counts the closes of each session key.
+type closeCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCloseCounter() *closeCounter {
+	return &closeCounter{counts: make(map[string]int)}
+}
+
+func (c *closeCounter) close(key string) func() {
+	return func() {
+		c.mu.Lock()
+		c.counts[key]++
+		c.mu.Unlock()
+	}
+}
+
+func (c *closeCounter) count(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[key]
+}
+
+// setIdle makes s look idle for d.
+func setIdle(s *udpSession, d time.Duration) {
+	atomic.StoreInt64(&s.lastActive, time.Now().Add(-d).UnixNano())
+}
+
+func TestUdpTableExpire(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	tests := []struct {
+		name string
+		// the session is touched every 10ms for this long
+		activeFor time.Duration
+	}{
+		{"idle", 0},
+		{"active past the timeout", 5 * timeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			closes := newCloseCounter()
+			table := newUdpTable("test-expire-"+tt.name, timeout, 0)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go table.expire(ctx)
+
+			s := table.add("a", closes.close("a"))
+			for start := time.Now(); time.Since(start) < tt.activeFor; time.Sleep(10 * time.Millisecond) {
+				s.touch()
+				if closes.count("a") != 0 {
+					t.Fatalf("active session expired after %v", time.Since(start))
+				}
+			}
+			if table.get("a") != s {
+				t.Fatal("active session left the table")
+			}
+
+			// expire ticks every half timeout, so an idle session goes
+			// within 1.5 timeouts
+			deadline := time.Now().Add(timeout*3/2 + 50*time.Millisecond)
+			for closes.count("a") == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("idle session not expired within 1.5 timeouts")
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if table.get("a") != nil {
+				t.Fatal("expired session still in the table")
+			}
+		})
+	}
+}
+
+func TestUdpTableEvictsLeastRecentlyActive(t *testing.T) {
+	keys := []string{"a", "b", "c", "d"}
+	for oldest := range keys {
+		t.Run("oldest "+keys[oldest], func(t *testing.T) {
+			side := "test-evict-" + keys[oldest]
+			base := gaugeValue(t, side)
+			closes := newCloseCounter()
+			table := newUdpTable(side, time.Minute, len(keys))
+			for i, key := range keys {
+				s := table.add(key, closes.close(key))
+				idle := time.Duration(i+1) * time.Second
+				if i == oldest {
+					idle = time.Hour
+				}
+				setIdle(s, idle)
+			}
+			table.add("new", closes.close("new"))
+
+			for _, key := range keys {
+				want := 0
+				if key == keys[oldest] {
+					want = 1
+				}
+				if got := closes.count(key); got != want {
+					t.Errorf("session %v closed %d times, want %d", key, got, want)
+				}
+				if (table.get(key) == nil) != (want == 1) {
+					t.Errorf("session %v in table: %v", key, table.get(key) != nil)
+				}
+			}
+			if got := gaugeValue(t, side) - base; got != float64(len(keys)) {
+				t.Errorf("gauge went up by %v, want %d", got, len(keys))
+			}
+		})
+	}
+}
+
+func TestUdpTableRemove(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(table *udpTable, s *udpSession)
+	}{
+		{"twice", func(table *udpTable, s *udpSession) {
+			table.remove(s)
+			table.remove(s)
+		}},
+		{"then closeAll", func(table *udpTable, s *udpSession) {
+			table.remove(s)
+			table.closeAll()
+		}},
+		{"concurrently", func(table *udpTable, s *udpSession) {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					table.remove(s)
+				}()
+			}
+			wg.Wait()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			side := "test-remove-" + tt.name
+			base := gaugeValue(t, side)
+			closes := newCloseCounter()
+			table := newUdpTable(side, time.Minute, 0)
+			s := table.add("a", closes.close("a"))
+			tt.remove(table, s)
+			if got := closes.count("a"); got != 1 {
+				t.Errorf("closed %d times, want once", got)
+			}
+			if got := gaugeValue(t, side); got != base {
+				t.Errorf("gauge %v, want %v", got, base)
+			}
+
+			// a stale entry does not remove the session taking its key
+			next := table.add("a", closes.close("a"))
+			table.remove(s)
+			if table.get("a") != next {
+				t.Error("removing a stale entry removed its successor")
+			}
+		})
+	}
+}
+
+func TestUdpTableCloseAllRacingExpire(t *testing.T) {
+	const side = "test-close-all"
+	const timeout = 10 * time.Millisecond
+	base := gaugeValue(t, side)
+	for round := 0; round < 20; round++ {
+		closes := newCloseCounter()
+		table := newUdpTable(side, timeout, 0)
+		ctx, cancel := context.WithCancel(context.Background())
+		var sessions []*udpSession
+		for i := 0; i < 50; i++ {
+			key := strconv.Itoa(i)
+			s := table.add(key, closes.close(key))
+			// half of them are due to expire on the next tick
+			if i%2 == 0 {
+				setIdle(s, time.Hour)
+			}
+			sessions = append(sessions, s)
+		}
+		done := make(chan struct{})
+		go func() {
+			table.expire(ctx)
+			close(done)
+		}()
+		time.Sleep(timeout / 2)
+		table.closeAll()
+		cancel()
+		<-done
+
+		for _, s := range sessions {
+			if got := closes.count(s.key); got != 1 {
+				t.Fatalf("round %d: session %v closed %d times", round, s.key, got)
+			}
+		}
+		if got := gaugeValue(t, side); got != base {
+			t.Fatalf("round %d: gauge %v, want %v", round, got, base)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Package metrics keeps counters, gauges and histograms and exports them in
+// the Prometheus text format, without depending on the Prometheus client.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry is a set of metric families exported together.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// Default is the registry the New functions register with.
+var Default = new(Registry)
+
+// family is a named metric with a set of labels, holding one series per
+// combination of label values.
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       uint64 // float64 bits, the sum for histograms
+	count       uint64
+	buckets     []uint64
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %v expects %v label values, got %v", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string(nil), labelValues...),
+			buckets:     make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *series) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&s.value)
+		if atomic.CompareAndSwapUint64(&s.value, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (s *series) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.value))
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	f *family
+}
+
+// NewCounterVec registers a counter with Default.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{Default.register(name, help, "counter", nil, labels)}
+}
+
+// With returns the counter of the given label values, in the order of the
+// labels.
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{v.f.with(labelValues)}
+}
+
+// Counter only goes up.
+type Counter struct {
+	s *series
+}
+
+func (c *Counter) Inc() {
+	c.s.add(1)
+}
+
+// Add adds delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	c.s.add(delta)
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	f *family
+}
+
+// NewGaugeVec registers a gauge with Default.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{Default.register(name, help, "gauge", nil, labels)}
+}
+
+// With returns the gauge of the given label values, in the order of the
+// labels.
+func (v *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{v.f.with(labelValues)}
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	s *series
+}
+
+func (g *Gauge) Inc() {
+	g.s.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.s.add(-1)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.s.add(delta)
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	f *family
+}
+
+// DefaultBuckets suit latencies in seconds, from 5ms to 10s.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewHistogramVec registers a histogram with Default. buckets are the
+// upper bounds of the buckets in increasing order.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{Default.register(name, help, "histogram", buckets, labels)}
+}
+
+// With returns the histogram of the given label values, in the order of
+// the labels.
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{v.f, v.f.with(labelValues)}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	f *family
+	s *series
+}
+
+func (h *Histogram) Observe(v float64) {
+	// buckets are exported cumulatively, an observation is counted in the
+	// first bucket it fits in only
+	if i := sort.SearchFloat64s(h.f.buckets, v); i < len(h.s.buckets) {
+		atomic.AddUint64(&h.s.buckets[i], 1)
+	}
+	atomic.AddUint64(&h.s.count, 1)
+	h.s.add(v)
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].labelValues, "\xff") < strings.Join(all[j].labelValues, "\xff")
+	})
+
+	fmt.Fprintf(w, "# HELP %v %v\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", f.name, f.kind)
+	for _, s := range all {
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", f.name, f.labelPairs(s, ""), formatFloat(s.load()))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += atomic.LoadUint64(&s.buckets[i])
+			fmt.Fprintf(w, "%v_bucket%v %v\n", f.name, f.labelPairs(s, formatFloat(bound)), cumulative)
+		}
+		count := atomic.LoadUint64(&s.count)
+		fmt.Fprintf(w, "%v_bucket%v %v\n", f.name, f.labelPairs(s, "+Inf"), count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", f.name, f.labelPairs(s, ""), formatFloat(s.load()))
+		fmt.Fprintf(w, "%v_count%v %v\n", f.name, f.labelPairs(s, ""), count)
+	}
+}
+
+// labelPairs formats the labels of s, adding le if not empty.
+func (f *family) labelPairs(s *series, le string) string {
+	pairs := make([]string, 0, len(f.labels)+1)
+	for i, l := range f.labels {
+		pairs = append(pairs, l+"="+strconv.Quote(s.labelValues[i]))
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the metrics of Default.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Write(w)
+	})
+}
@@ -23,6 +23,18 @@ func ServerDesc(name string) grpc.ServiceDesc {
 				ServerStreams: true,
 				ClientStreams: true,
 			},
+			{
+				StreamName:    "TunMulti",
+				Handler:       _GunService_TunMulti_Handler,
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+			{
+				StreamName:    "Reverse",
+				Handler:       _GunService_Reverse_Handler,
+				ServerStreams: true,
+				ClientStreams: true,
+			},
 		},
 		Metadata: "gun.proto",
 	}
@@ -37,10 +49,42 @@ func (c *gunServiceClient) TunCustomName(ctx context.Context, name string, opts
 	return x, nil
 }
 
+func (c *gunServiceClient) TunDatagramCustomName(ctx context.Context, name string, opts ...grpc.CallOption) (GunService_TunDatagramClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ServerDesc(name).Streams[1], "/"+name+"/TunDatagram", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gunServiceTunDatagramClient{stream}
+	return x, nil
+}
+
+func (c *gunServiceClient) TunMultiCustomName(ctx context.Context, name string, opts ...grpc.CallOption) (GunService_TunMultiClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ServerDesc(name).Streams[2], "/"+name+"/TunMulti", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gunServiceTunMultiClient{stream}
+	return x, nil
+}
+
+func (c *gunServiceClient) ReverseCustomName(ctx context.Context, name string, opts ...grpc.CallOption) (GunService_ReverseClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ServerDesc(name).Streams[3], "/"+name+"/Reverse", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gunServiceReverseClient{stream}
+	return x, nil
+}
+
 type GunServiceClientX interface {
 	TunCustomName(ctx context.Context, name string, opts ...grpc.CallOption) (GunService_TunClient, error)
+	TunDatagramCustomName(ctx context.Context, name string, opts ...grpc.CallOption) (GunService_TunDatagramClient, error)
+	TunMultiCustomName(ctx context.Context, name string, opts ...grpc.CallOption) (GunService_TunMultiClient, error)
+	ReverseCustomName(ctx context.Context, name string, opts ...grpc.CallOption) (GunService_ReverseClient, error)
 	Tun(ctx context.Context, opts ...grpc.CallOption) (GunService_TunClient, error)
 	TunDatagram(ctx context.Context, opts ...grpc.CallOption) (GunService_TunDatagramClient, error)
+	TunMulti(ctx context.Context, opts ...grpc.CallOption) (GunService_TunMultiClient, error)
+	Reverse(ctx context.Context, opts ...grpc.CallOption) (GunService_ReverseClient, error)
 }
 
 func RegisterGunServiceServerX(s *grpc.Server, srv GunServiceServer, name string) {
@@ -25,7 +25,22 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type Hunk struct {
-	Data                 []byte   `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	Data []byte `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	// ack is the number of bytes received by the sender on a resumable stream
+	Ack uint64 `protobuf:"varint,2,opt,name=ack,proto3" json:"ack,omitempty"`
+	// fin tells the peer of a resumable stream that the sender is done
+	// sending, the stream stays open to carry acks
+	Fin bool `protobuf:"varint,3,opt,name=fin,proto3" json:"fin,omitempty"`
+	// padding is ignored, it hides the size of data on shaped streams
+	Padding []byte `protobuf:"bytes,4,opt,name=padding,proto3" json:"padding,omitempty"`
+	// addr is the peer of a datagram on an addressed TunDatagram stream, the
+	// destination when sent by the client and the source when sent by the
+	// server
+	Addr string `protobuf:"bytes,5,opt,name=addr,proto3" json:"addr,omitempty"`
+	// dummy marks a hunk sent only to hide the timing of a shaped stream, it
+	// is dropped by the receiver. A hunk without data is not a dummy by
+	// itself, it may be an empty datagram
+	Dummy                bool     `protobuf:"varint,6,opt,name=dummy,proto3" json:"dummy,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -63,24 +78,106 @@ func (m *Hunk) GetData() []byte {
 	return nil
 }
 
+func (m *Hunk) GetAck() uint64 {
+	if m != nil {
+		return m.Ack
+	}
+	return 0
+}
+
+func (m *Hunk) GetFin() bool {
+	if m != nil {
+		return m.Fin
+	}
+	return false
+}
+
+func (m *Hunk) GetPadding() []byte {
+	if m != nil {
+		return m.Padding
+	}
+	return nil
+}
+
+func (m *Hunk) GetAddr() string {
+	if m != nil {
+		return m.Addr
+	}
+	return ""
+}
+
+func (m *Hunk) GetDummy() bool {
+	if m != nil {
+		return m.Dummy
+	}
+	return false
+}
+
+type MultiHunk struct {
+	Data                 [][]byte `protobuf:"bytes,1,rep,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MultiHunk) Reset()         { *m = MultiHunk{} }
+func (m *MultiHunk) String() string { return proto.CompactTextString(m) }
+func (*MultiHunk) ProtoMessage()    {}
+func (*MultiHunk) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5eb68c7936423302, []int{1}
+}
+
+func (m *MultiHunk) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MultiHunk.Unmarshal(m, b)
+}
+func (m *MultiHunk) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MultiHunk.Marshal(b, m, deterministic)
+}
+func (m *MultiHunk) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MultiHunk.Merge(m, src)
+}
+func (m *MultiHunk) XXX_Size() int {
+	return xxx_messageInfo_MultiHunk.Size(m)
+}
+func (m *MultiHunk) XXX_DiscardUnknown() {
+	xxx_messageInfo_MultiHunk.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MultiHunk proto.InternalMessageInfo
+
+func (m *MultiHunk) GetData() [][]byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Hunk)(nil), "Hunk")
+	proto.RegisterType((*MultiHunk)(nil), "MultiHunk")
 }
 
 func init() { proto.RegisterFile("gun.proto", fileDescriptor_5eb68c7936423302) }
 
 var fileDescriptor_5eb68c7936423302 = []byte{
-	// 146 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x4c, 0x2f, 0xcd, 0xd3,
-	0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x57, 0x92, 0xe2, 0x62, 0xf1, 0x28, 0xcd, 0xcb, 0x16, 0x12, 0xe2,
-	0x62, 0x49, 0x49, 0x2c, 0x49, 0x94, 0x60, 0x54, 0x60, 0xd4, 0xe0, 0x09, 0x02, 0xb3, 0x8d, 0xdc,
-	0xb8, 0xb8, 0xdc, 0x4b, 0xf3, 0x82, 0x53, 0x8b, 0xca, 0x32, 0x93, 0x53, 0x85, 0xc4, 0xb9, 0x98,
-	0x43, 0x4a, 0xf3, 0x84, 0x58, 0xf5, 0x40, 0xea, 0xa5, 0x20, 0x94, 0x06, 0xa3, 0x01, 0xa3, 0x90,
-	0x3c, 0x17, 0x77, 0x48, 0x69, 0x9e, 0x4b, 0x62, 0x49, 0x62, 0x7a, 0x51, 0x62, 0x2e, 0xa6, 0x02,
-	0x27, 0xc5, 0x28, 0xf9, 0xf4, 0xcc, 0x92, 0x8c, 0xd2, 0x24, 0xbd, 0xe4, 0xfc, 0x5c, 0xfd, 0xc0,
-	0x32, 0xa3, 0xa2, 0xc4, 0x4a, 0xfd, 0xf4, 0xd2, 0x3c, 0xfd, 0x82, 0xec, 0x74, 0x7d, 0xb0, 0x33,
-	0x92, 0xd8, 0xc0, 0x94, 0x31, 0x20, 0x00, 0x00, 0xff, 0xff, 0xae, 0x3c, 0x46, 0x28, 0x9a, 0x00,
-	0x00, 0x00,
+	// 257 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x90, 0xbf, 0x4b, 0xc4, 0x30,
+	0x14, 0xc7, 0x89, 0x6d, 0xef, 0xae, 0x4f, 0x07, 0x09, 0x82, 0xe1, 0x1c, 0x5a, 0x6f, 0x90, 0x4e,
+	0xad, 0x9c, 0xff, 0x81, 0x08, 0xba, 0x38, 0x58, 0x3b, 0xb9, 0xe5, 0x9a, 0x18, 0x43, 0x6d, 0x5a,
+	0x62, 0x5e, 0xe1, 0x56, 0x57, 0xff, 0x69, 0x49, 0x8e, 0x13, 0xd1, 0x9b, 0xde, 0xe7, 0x85, 0xf7,
+	0xfd, 0x41, 0x20, 0x55, 0x68, 0xca, 0xd1, 0x0e, 0x6e, 0x58, 0x7d, 0x12, 0x88, 0x1f, 0xd0, 0x74,
+	0x94, 0x42, 0x2c, 0xb8, 0xe3, 0x8c, 0xe4, 0xa4, 0x38, 0xa9, 0x03, 0xd3, 0x53, 0x88, 0x78, 0xdb,
+	0xb1, 0xa3, 0x9c, 0x14, 0x71, 0xed, 0xd1, 0xbf, 0xbc, 0x6a, 0xc3, 0xa2, 0x9c, 0x14, 0x8b, 0xda,
+	0x23, 0x65, 0x30, 0x1f, 0xb9, 0x10, 0xda, 0x28, 0x16, 0x07, 0xe9, 0x7e, 0xf5, 0x8e, 0x5c, 0x08,
+	0xcb, 0x92, 0x9c, 0x14, 0x69, 0x1d, 0x98, 0x9e, 0x41, 0x22, 0xb0, 0xef, 0xb7, 0x6c, 0x16, 0x1c,
+	0x76, 0xcb, 0x2a, 0x83, 0xf4, 0x11, 0xdf, 0x9d, 0xfe, 0x53, 0x24, 0xda, 0x17, 0x59, 0x7f, 0x11,
+	0x80, 0x7b, 0x34, 0xcf, 0xd2, 0x4e, 0xba, 0x95, 0xf4, 0x1c, 0xa2, 0x06, 0x0d, 0x4d, 0x4a, 0x2f,
+	0x58, 0xee, 0x46, 0x41, 0xae, 0x09, 0xcd, 0xe0, 0xb8, 0x41, 0x73, 0xc7, 0x1d, 0x57, 0x96, 0xf7,
+	0x07, 0x0e, 0xae, 0x60, 0xd1, 0xa0, 0x09, 0x61, 0x14, 0xca, 0x9f, 0xd0, 0xe5, 0x2f, 0x0e, 0x77,
+	0x17, 0x30, 0xaf, 0xe5, 0x24, 0xed, 0x87, 0xfc, 0x6f, 0x72, 0x7b, 0xf9, 0x92, 0x29, 0xed, 0xde,
+	0x70, 0x53, 0xb6, 0x43, 0x5f, 0x3d, 0x4d, 0x6b, 0xcb, 0xb7, 0x95, 0x42, 0x53, 0x8d, 0x9d, 0xaa,
+	0xc2, 0xb7, 0x6e, 0x66, 0x61, 0xdc, 0x7c, 0x0f, 0x00, 0x94, 0x21, 0x1a, 0x90, 0x6a, 0x01, 0x00,
+	0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -97,6 +194,11 @@ const _ = grpc.SupportPackageIsVersion4
 type GunServiceClient interface {
 	Tun(ctx context.Context, opts ...grpc.CallOption) (GunService_TunClient, error)
 	TunDatagram(ctx context.Context, opts ...grpc.CallOption) (GunService_TunDatagramClient, error)
+	TunMulti(ctx context.Context, opts ...grpc.CallOption) (GunService_TunMultiClient, error)
+	// Reverse is either the control stream of a reverse tunnel, telling the
+	// client the id of each connection accepted by the server, or the stream
+	// carrying the connection of an id
+	Reverse(ctx context.Context, opts ...grpc.CallOption) (GunService_ReverseClient, error)
 }
 
 type gunServiceClient struct {
@@ -169,10 +271,77 @@ func (x *gunServiceTunDatagramClient) Recv() (*Hunk, error) {
 	return m, nil
 }
 
+func (c *gunServiceClient) TunMulti(ctx context.Context, opts ...grpc.CallOption) (GunService_TunMultiClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_GunService_serviceDesc.Streams[2], "/GunService/TunMulti", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gunServiceTunMultiClient{stream}
+	return x, nil
+}
+
+type GunService_TunMultiClient interface {
+	Send(*MultiHunk) error
+	Recv() (*MultiHunk, error)
+	grpc.ClientStream
+}
+
+type gunServiceTunMultiClient struct {
+	grpc.ClientStream
+}
+
+func (x *gunServiceTunMultiClient) Send(m *MultiHunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *gunServiceTunMultiClient) Recv() (*MultiHunk, error) {
+	m := new(MultiHunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *gunServiceClient) Reverse(ctx context.Context, opts ...grpc.CallOption) (GunService_ReverseClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_GunService_serviceDesc.Streams[3], "/GunService/Reverse", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &gunServiceReverseClient{stream}
+	return x, nil
+}
+
+type GunService_ReverseClient interface {
+	Send(*Hunk) error
+	Recv() (*Hunk, error)
+	grpc.ClientStream
+}
+
+type gunServiceReverseClient struct {
+	grpc.ClientStream
+}
+
+func (x *gunServiceReverseClient) Send(m *Hunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *gunServiceReverseClient) Recv() (*Hunk, error) {
+	m := new(Hunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // GunServiceServer is the server API for GunService service.
 type GunServiceServer interface {
 	Tun(GunService_TunServer) error
 	TunDatagram(GunService_TunDatagramServer) error
+	TunMulti(GunService_TunMultiServer) error
+	// Reverse is either the control stream of a reverse tunnel, telling the
+	// client the id of each connection accepted by the server, or the stream
+	// carrying the connection of an id
+	Reverse(GunService_ReverseServer) error
 }
 
 // UnimplementedGunServiceServer can be embedded to have forward compatible implementations.
@@ -185,6 +354,12 @@ func (*UnimplementedGunServiceServer) Tun(srv GunService_TunServer) error {
 func (*UnimplementedGunServiceServer) TunDatagram(srv GunService_TunDatagramServer) error {
 	return status.Errorf(codes.Unimplemented, "method TunDatagram not implemented")
 }
+func (*UnimplementedGunServiceServer) TunMulti(srv GunService_TunMultiServer) error {
+	return status.Errorf(codes.Unimplemented, "method TunMulti not implemented")
+}
+func (*UnimplementedGunServiceServer) Reverse(srv GunService_ReverseServer) error {
+	return status.Errorf(codes.Unimplemented, "method Reverse not implemented")
+}
 
 func RegisterGunServiceServer(s *grpc.Server, srv GunServiceServer) {
 	s.RegisterService(&_GunService_serviceDesc, srv)
@@ -242,6 +417,58 @@ func (x *gunServiceTunDatagramServer) Recv() (*Hunk, error) {
 	return m, nil
 }
 
+func _GunService_TunMulti_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GunServiceServer).TunMulti(&gunServiceTunMultiServer{stream})
+}
+
+type GunService_TunMultiServer interface {
+	Send(*MultiHunk) error
+	Recv() (*MultiHunk, error)
+	grpc.ServerStream
+}
+
+type gunServiceTunMultiServer struct {
+	grpc.ServerStream
+}
+
+func (x *gunServiceTunMultiServer) Send(m *MultiHunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *gunServiceTunMultiServer) Recv() (*MultiHunk, error) {
+	m := new(MultiHunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _GunService_Reverse_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GunServiceServer).Reverse(&gunServiceReverseServer{stream})
+}
+
+type GunService_ReverseServer interface {
+	Send(*Hunk) error
+	Recv() (*Hunk, error)
+	grpc.ServerStream
+}
+
+type gunServiceReverseServer struct {
+	grpc.ServerStream
+}
+
+func (x *gunServiceReverseServer) Send(m *Hunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *gunServiceReverseServer) Recv() (*Hunk, error) {
+	m := new(Hunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _GunService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "GunService",
 	HandlerType: (*GunServiceServer)(nil),
@@ -259,6 +486,18 @@ var _GunService_serviceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "TunMulti",
+			Handler:       _GunService_TunMulti_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Reverse",
+			Handler:       _GunService_Reverse_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "gun.proto",
 }
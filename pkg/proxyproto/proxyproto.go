@@ -0,0 +1,264 @@
+// Package proxyproto reads PROXY protocol v1 and v2 headers on accepted
+// connections and writes v2 headers, so the address of the original client
+// survives load balancers and tunnels.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signature starts every v2 header.
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	v2CommandLocal = 0x20
+	v2CommandProxy = 0x21
+
+	v2FamilyTCP4 = 0x11
+	v2FamilyUDP4 = 0x12
+	v2FamilyTCP6 = 0x21
+	v2FamilyUDP6 = 0x22
+)
+
+var errNoHeader = errors.New("no PROXY protocol header")
+
+// Listener accepts connections starting with a PROXY protocol header, and
+// reports the addresses it carries. Connections without a header fail.
+type Listener struct {
+	net.Listener
+	// Timeout bounds reading the header, defaults to 10 seconds
+	Timeout time.Duration
+}
+
+// NewListener wraps l to read PROXY protocol headers.
+func NewListener(l net.Listener) *Listener {
+	return &Listener{Listener: l}
+}
+
+// Accept returns the next connection. The header is read on the first use
+// of the connection, so a slow client does not hold up the others.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// Conn is a connection accepted by Listener.
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remote, c.local, c.err = ReadHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("bad PROXY protocol header from %v: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the source address of the header, or that of the
+// connection if the header carries none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header, or that of the
+// connection if the header carries none.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ReadHeader reads a v1 or v2 header from r and returns the source and
+// destination addresses it carries. Both are nil for headers of the LOCAL
+// command or an unknown protocol.
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// both versions are longer than the v2 signature
+	prefix, err := r.Peek(len(signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.Equal(prefix, signature):
+		return readV2(r)
+	case bytes.HasPrefix(prefix, []byte(v1Prefix)):
+		return readV1(r)
+	}
+	return nil, nil, errNoHeader
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	if src, err = parseV1Addr(fields[2], fields[4]); err != nil {
+		return nil, nil, err
+	}
+	if dst, err = parseV1Addr(fields[3], fields[5]); err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 reads a binary header, ignoring its TLVs.
+func readV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, err
+	}
+	command, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch command {
+	case v2CommandLocal:
+		return nil, nil, nil
+	case v2CommandProxy:
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 version and command %#x", command)
+	}
+
+	var ipLen int
+	switch family {
+	case v2FamilyTCP4, v2FamilyUDP4:
+		ipLen = net.IPv4len
+	case v2FamilyTCP6, v2FamilyUDP6:
+		ipLen = net.IPv6len
+	default:
+		// unix sockets and unspecified families carry nothing useful
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("v2 header too short for its addresses")
+	}
+	srcIP := net.IP(body[:ipLen])
+	dstIP := net.IP(body[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	if family == v2FamilyUDP4 || family == v2FamilyUDP6 {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+// AppendV2 appends a v2 header for a connection from src to dst to b. The
+// family is UDP when dst is a *net.UDPAddr and TCP otherwise. Addresses
+// which are not IPs make a header of the LOCAL command.
+func AppendV2(b []byte, src, dst net.Addr) []byte {
+	b = append(b, signature...)
+	srcIP, srcPort := splitAddr(src)
+	dstIP, dstPort := splitAddr(dst)
+	if srcIP == nil || dstIP == nil {
+		return append(b, v2CommandLocal, 0, 0, 0)
+	}
+
+	_, udp := dst.(*net.UDPAddr)
+	family := byte(v2FamilyTCP6)
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		family, srcIP, dstIP = v2FamilyTCP4, src4, dst4
+	} else {
+		// families must match, IPv4 is mapped into IPv6
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+	if udp {
+		family++
+	}
+
+	b = append(b, v2CommandProxy, family)
+	b = appendUint16(b, 2*len(srcIP)+4)
+	b = append(b, srcIP...)
+	b = append(b, dstIP...)
+	b = appendUint16(b, srcPort)
+	return appendUint16(b, dstPort)
+}
+
+func appendUint16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
@@ -0,0 +1,207 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func udpAddr(s string) *net.UDPAddr {
+	addr, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// sameAddr compares addresses by network, IP and port, IPv4 mapped into
+// IPv6 being the same as IPv4.
+func sameAddr(a, b net.Addr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if a.Network() != b.Network() {
+		return false
+	}
+	aIP, aPort := splitAddr(a)
+	bIP, bPort := splitAddr(b)
+	return aIP.Equal(bIP) && aPort == bPort
+}
+
+func TestV2RoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		// nil for a LOCAL header
+		wantSrc, wantDst net.Addr
+	}{
+		{"tcp4", tcpAddr("192.0.2.1:56324"), tcpAddr("192.0.2.2:443"), tcpAddr("192.0.2.1:56324"), tcpAddr("192.0.2.2:443")},
+		{"tcp6", tcpAddr("[2001:db8::1]:56324"), tcpAddr("[2001:db8::2]:443"), tcpAddr("[2001:db8::1]:56324"), tcpAddr("[2001:db8::2]:443")},
+		{"udp4", udpAddr("192.0.2.1:5353"), udpAddr("192.0.2.2:53"), udpAddr("192.0.2.1:5353"), udpAddr("192.0.2.2:53")},
+		{"udp6", udpAddr("[2001:db8::1]:5353"), udpAddr("[2001:db8::2]:53"), udpAddr("[2001:db8::1]:5353"), udpAddr("[2001:db8::2]:53")},
+		{"mixed families", tcpAddr("192.0.2.1:1"), tcpAddr("[2001:db8::2]:2"), tcpAddr("[::ffff:192.0.2.1]:1"), tcpAddr("[2001:db8::2]:2")},
+		{"udp to tcp source", tcpAddr("192.0.2.1:1"), udpAddr("192.0.2.2:2"), udpAddr("192.0.2.1:1"), udpAddr("192.0.2.2:2")},
+		{"port bounds", tcpAddr("192.0.2.1:0"), tcpAddr("192.0.2.2:65535"), tcpAddr("192.0.2.1:0"), tcpAddr("192.0.2.2:65535")},
+		{"no source", nil, tcpAddr("192.0.2.2:443"), nil, nil},
+		{"unix source", &net.UnixAddr{Name: "/run/gun.sock", Net: "unix"}, tcpAddr("192.0.2.2:443"), nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := AppendV2([]byte("prefix"), tt.src, tt.dst)
+			if !bytes.HasPrefix(b, []byte("prefix")) {
+				t.Fatal("AppendV2 dropped the bytes it appends to")
+			}
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(b[len("prefix"):]), strings.NewReader("payload")))
+			src, dst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameAddr(src, tt.wantSrc) || !sameAddr(dst, tt.wantDst) {
+				t.Fatalf("read %v -> %v, want %v -> %v", src, dst, tt.wantSrc, tt.wantDst)
+			}
+			// the header is consumed exactly
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("data after the header: %q", rest)
+			}
+		})
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	tests := []struct {
+		name, header     string
+		wantSrc, wantDst net.Addr
+	}{
+		{"tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", tcpAddr("192.0.2.1:56324"), tcpAddr("192.0.2.2:443")},
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", tcpAddr("[2001:db8::1]:56324"), tcpAddr("[2001:db8::2]:443")},
+		{"unknown", "PROXY UNKNOWN\r\n", nil, nil},
+		{"unknown with addresses", "PROXY UNKNOWN 192.0.2.1 192.0.2.2 56324 443\r\n", nil, nil},
+		{"longest", "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n",
+			tcpAddr("[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535"), tcpAddr("[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "payload"))
+			src, dst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameAddr(src, tt.wantSrc) || !sameAddr(dst, tt.wantDst) {
+				t.Fatalf("read %v -> %v, want %v -> %v", src, dst, tt.wantSrc, tt.wantDst)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("data after the header: %q", rest)
+			}
+		})
+	}
+}
+
+// v2Header builds a v2 header of command and family around body, with the
+// length of the body given separately.
+func v2Header(command, family byte, length int, body []byte) string {
+	b := append([]byte(nil), signature...)
+	b = append(b, command, family)
+	b = appendUint16(b, length)
+	return string(append(b, body...))
+}
+
+func TestReadHeaderMalformed(t *testing.T) {
+	tcp4Body := make([]byte, 12)
+	tests := []struct {
+		name, header string
+	}{
+		{"empty", ""},
+		{"no header", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+		{"v1 lowercase", "proxy TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"},
+		{"v1 too long", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443" + strings.Repeat(" ", v1MaxLength) + "\r\n"},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n"},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 192.0.2.2"},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n"},
+		{"v1 extra field", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443 1\r\n"},
+		{"v1 udp", "PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n"},
+		{"v1 bad source", "PROXY TCP4 192.0.2.256 192.0.2.2 56324 443\r\n"},
+		{"v1 bad destination", "PROXY TCP4 192.0.2.1 example.com 56324 443\r\n"},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n"},
+		{"v1 negative port", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 -1\r\n"},
+		{"v2 truncated signature", string(signature[:8])},
+		{"v2 truncated header", string(signature) + "\x21"},
+		{"v2 truncated body", v2Header(v2CommandProxy, v2FamilyTCP4, 12, tcp4Body[:6])},
+		{"v2 unknown command", v2Header(0x22, v2FamilyTCP4, 12, tcp4Body)},
+		{"v2 version 1", v2Header(0x11, v2FamilyTCP4, 12, tcp4Body)},
+		{"v2 body too short for tcp4", v2Header(v2CommandProxy, v2FamilyTCP4, 8, tcp4Body[:8])},
+		{"v2 body too short for tcp6", v2Header(v2CommandProxy, v2FamilyTCP6, 12, tcp4Body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, dst, err := ReadHeader(bufio.NewReader(strings.NewReader(tt.header)))
+			if err == nil {
+				t.Fatalf("read %v -> %v, want an error", src, dst)
+			}
+		})
+	}
+}
+
+func TestReadV2Ignored(t *testing.T) {
+	tests := []struct {
+		name, header string
+	}{
+		{"local", v2Header(v2CommandLocal, 0, 0, nil)},
+		{"local with body", v2Header(v2CommandLocal, v2FamilyTCP4, 12, make([]byte, 12))},
+		{"unspecified family", v2Header(v2CommandProxy, 0, 0, nil)},
+		{"unix family", v2Header(v2CommandProxy, 0x31, 216, make([]byte, 216))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.header + "payload"))
+			src, dst, err := ReadHeader(r)
+			if err != nil || src != nil || dst != nil {
+				t.Fatalf("read %v -> %v, %v, want no addresses", src, dst, err)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("data after the header: %q", rest)
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(l)
+	defer listener.Close()
+
+	src, dst := tcpAddr("192.0.2.1:56324"), tcpAddr("192.0.2.2:443")
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(append(AppendV2(nil, src, dst), "payload"...))
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !sameAddr(conn.RemoteAddr(), src) || !sameAddr(conn.LocalAddr(), dst) {
+		t.Fatalf("connection %v -> %v, want %v -> %v", conn.RemoteAddr(), conn.LocalAddr(), src, dst)
+	}
+	if rest, _ := io.ReadAll(conn); string(rest) != "payload" {
+		t.Fatalf("data after the header: %q", rest)
+	}
+}
@@ -0,0 +1,122 @@
+// Package ratelimit bounds bandwidth with token buckets, one token being a
+// byte.
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStopped is returned by Wait when it is stopped before the bytes may
+// pass.
+var ErrStopped = errors.New("rate limit wait stopped")
+
+// Bucket lets bytes pass at a steady rate, and bursts of up to its size
+// after being idle. A nil *Bucket does not limit.
+type Bucket struct {
+	mu    sync.Mutex
+	rate  float64
+	burst float64
+	// tokens goes negative when bytes are taken ahead of time, later
+	// takers wait for the debt to be paid off first
+	tokens float64
+	last   time.Time
+}
+
+// New returns a bucket letting rate bytes per second pass, or nil if rate
+// is not positive. It starts full.
+func New(rate, burst int64) *Bucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &Bucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take takes n tokens and returns how long to wait for them.
+func (b *Bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back n tokens taken but not used.
+func (b *Bucket) refund(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(n)
+}
+
+// Wait blocks until n bytes may pass every bucket, or done is closed.
+// Tokens are taken from all buckets at once, so the slowest one sets the
+// pace. Amounts beyond the burst size pass too, after a longer wait.
+func Wait(done <-chan struct{}, n int, buckets ...*Bucket) error {
+	var delay time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		if d := b.take(n); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		for _, b := range buckets {
+			if b != nil {
+				b.refund(n)
+			}
+		}
+		return ErrStopped
+	}
+}
+
+// ParseRate parses a rate in bytes per second like "512K" or "10M". The
+// suffixes K, M and G are powers of 1024, and may be followed by B.
+func ParseRate(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := int64(1)
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	// NaN fails both comparisons, infinities and overflows the upper one
+	n *= float64(unit)
+	if err != nil || !(n >= 0 && n < math.MaxInt64) {
+		return 0, errors.New("rate must be bytes per second like 512K or 10M")
+	}
+	return int64(n), nil
+}
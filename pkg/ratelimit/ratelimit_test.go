@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1000", 1000, true},
+		{"512K", 512 << 10, true},
+		{"512k", 512 << 10, true},
+		{"10M", 10 << 20, true},
+		{"10MB", 10 << 20, true},
+		{"1.5G", 3 << 29, true},
+		{" 2K ", 2 << 10, true},
+		{"100B", 100, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"M10", 0, false},
+		{"10T", 0, false},
+		{"-1M", 0, false},
+		{"fast", 0, false},
+		{"1M:10M", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"1e30G", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRate(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParseRate(%q) error %v, want ok %v", tt.in, err, tt.ok)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseRate(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewUnlimited(t *testing.T) {
+	if b := New(0, 100); b != nil {
+		t.Fatal("bucket with no rate limits")
+	}
+	start := time.Now()
+	if err := Wait(nil, 1<<30, nil, New(-1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("unlimited wait took %v", elapsed)
+	}
+}
+
+// near reports whether d is within 20ms of want, leaving room for the time
+// passing between takes.
+func near(d, want time.Duration) bool {
+	return d >= want-20*time.Millisecond && d <= want+20*time.Millisecond
+}
+
+func TestBucketTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int64
+		burst int64
+		// takes are taken in turn, each waiting for the delay before
+		takes []int
+		want  []time.Duration
+	}{
+		{"within burst", 1000, 500, []int{200, 300}, []time.Duration{0, 0}},
+		{"beyond burst", 1000, 500, []int{500, 100}, []time.Duration{0, 100 * time.Millisecond}},
+		{"burst defaults to rate", 1000, 0, []int{1000, 250}, []time.Duration{0, 250 * time.Millisecond}},
+		{"debt adds up", 1000, 100, []int{100, 200, 300}, []time.Duration{0, 200 * time.Millisecond, 500 * time.Millisecond}},
+		{"more than burst at once", 1000, 100, []int{600}, []time.Duration{500 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New(tt.rate, tt.burst)
+			for i, n := range tt.takes {
+				if d := b.take(n); !near(d, tt.want[i]) {
+					t.Fatalf("take %d of %d bytes: wait %v, want %v", i, n, d, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	b := New(1000, 200)
+	if d := b.take(200); d != 0 {
+		t.Fatalf("first take waits %v", d)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// 100 bytes came back
+	if d := b.take(100); !near(d, 0) {
+		t.Fatalf("take after refill waits %v", d)
+	}
+	time.Sleep(time.Second)
+	// refilled up to the burst only
+	if d := b.take(300); !near(d, 100*time.Millisecond) {
+		t.Fatalf("take beyond the burst after idling waits %v", d)
+	}
+}
+
+func TestWait(t *testing.T) {
+	slow, fast := New(1000, 100), New(10000, 100)
+	if err := Wait(nil, 100, slow, fast); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := Wait(nil, 100, slow, fast); err != nil {
+		t.Fatal(err)
+	}
+	// the slowest bucket sets the pace
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Fatalf("wait took %v, want about 100ms", elapsed)
+	}
+}
+
+func TestWaitStoppedRefunds(t *testing.T) {
+	b := New(1000, 100)
+	if err := Wait(nil, 100, b); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	close(done)
+	start := time.Now()
+	if err := Wait(done, 500, b); err != ErrStopped {
+		t.Fatalf("stopped wait: %v, want %v", err, ErrStopped)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("stopped wait took %v", elapsed)
+	}
+	// the bytes which did not pass are not owed
+	if d := b.take(100); !near(d, 100*time.Millisecond) {
+		t.Fatalf("take after a stopped wait waits %v, want 100ms", d)
+	}
+}